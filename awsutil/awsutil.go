@@ -0,0 +1,22 @@
+// The awsutil package provides helpers for tasks that span several AWS
+// services
+package awsutil
+
+import (
+	"github.com/pivotal-cloudops/cloudops-goamz/elb"
+	"github.com/pivotal-cloudops/cloudops-goamz/route53"
+)
+
+// AliasRecordForLB returns an alias A record named name that points at the
+// load balancer lb, as described by DescribeLoadBalancers.
+func AliasRecordForLB(name string, lb elb.LoadBalancer, evaluateTargetHealth bool) route53.ResourceRecordSet {
+	return route53.ResourceRecordSet{
+		Name: route53.FQDN(name),
+		Type: "A",
+		AliasTarget: &route53.AliasTarget{
+			HostedZoneId:         lb.HostedZoneNameID,
+			DNSName:              route53.FQDN(lb.DNSName),
+			EvaluateTargetHealth: evaluateTargetHealth,
+		},
+	}
+}
@@ -0,0 +1,57 @@
+package awsutil_test
+
+import (
+	"testing"
+
+	"github.com/pivotal-cloudops/cloudops-goamz/aws"
+	"github.com/pivotal-cloudops/cloudops-goamz/awsutil"
+	"github.com/pivotal-cloudops/cloudops-goamz/elb"
+	"github.com/pivotal-cloudops/cloudops-goamz/elb/elbtest"
+	"github.com/pivotal-cloudops/cloudops-goamz/route53"
+	"github.com/pivotal-cloudops/cloudops-goamz/route53/route53test"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+func (s *S) TestAliasRecordForLB(c *C) {
+	elbSrv, err := elbtest.NewServer()
+	c.Assert(err, IsNil)
+	defer elbSrv.Quit()
+	r53Srv, err := route53test.NewServer()
+	c.Assert(err, IsNil)
+	defer r53Srv.Quit()
+	auth := aws.Auth{AccessKey: "key", SecretKey: "secret"}
+
+	elbSrv.NewLoadBalancer("testlb")
+	lbs, err := elb.New(auth, aws.Region{ELBEndpoint: elbSrv.URL()}).DescribeLoadBalancers(&elb.DescribeLoadBalancer{})
+	c.Assert(err, IsNil)
+	lb := lbs.LoadBalancers[0]
+
+	record := awsutil.AliasRecordForLB("www.example.com", lb, true)
+	c.Assert(record.Name, Equals, "www.example.com.")
+	c.Assert(record.Type, Equals, "A")
+	c.Assert(*record.AliasTarget, Equals, route53.AliasTarget{
+		HostedZoneId:         lb.HostedZoneNameID,
+		DNSName:              lb.DNSName + ".",
+		EvaluateTargetHealth: true,
+	})
+
+	// The record is accepted by Route53 as it is.
+	r53 := route53.New(auth, aws.Region{Route53Endpoint: r53Srv.URL()})
+	zone, err := r53.CreateHostedZone(&route53.CreateHostedZoneRequest{Name: "example.com.", CallerReference: "test"})
+	c.Assert(err, IsNil)
+	_, err = r53.ChangeResourceRecordSets(zone.HostedZone.ID, &route53.ChangeResourceRecordSetsRequest{
+		Changes: []route53.Change{{Action: "CREATE", Record: record}},
+	})
+	c.Assert(err, IsNil)
+	got, ok := r53Srv.AssertRecord("www.example.com.", "A")
+	c.Assert(ok, Equals, true)
+	c.Assert(got.AliasTarget.HostedZoneId, Equals, lb.HostedZoneNameID)
+}
@@ -4,9 +4,14 @@ package elb
 
 import (
 	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pivotal-cloudops/cloudops-goamz/aws"
@@ -51,10 +56,26 @@ func (elb *ELB) query(params map[string]string, resp interface{}) error {
 		return buildError(r)
 	}
 
-	decoder := xml.NewDecoder(r.Body)
-	decodedBody := decoder.Decode(resp)
+	return decodeResponse(r.Body, resp)
+}
 
-	return decodedBody
+// decodeResponse decodes the XML document read from body into resp. A proxy
+// in front of the service may answer with an HTML page instead, which is
+// reported as an error rather than decoded as an empty response.
+func decodeResponse(body io.Reader, resp interface{}) error {
+	decoder := xml.NewDecoder(body)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			if strings.EqualFold(start.Name.Local, "html") {
+				return fmt.Errorf("elb: unexpected HTML response")
+			}
+			return decoder.DecodeElement(resp, &start)
+		}
+	}
 }
 
 func buildError(r *http.Response) error {
@@ -66,6 +87,9 @@ func buildError(r *http.Response) error {
 	if len(errors.Errors) > 0 {
 		err = errors.Errors[0]
 	}
+	if err.RequestId == "" {
+		err.RequestId = errors.RequestId
+	}
 	err.StatusCode = r.StatusCode
 	if err.Message == "" {
 		err.Message = r.Status
@@ -92,11 +116,12 @@ func makeParams(action string) map[string]string {
 
 // A listener attaches to an elb
 type Listener struct {
-	InstancePort     int64  `xml:"Listener>InstancePort"`
-	InstanceProtocol string `xml:"Listener>InstanceProtocol"`
-	SSLCertificateId string `xml:"Listener>SSLCertificateId"`
-	LoadBalancerPort int64  `xml:"Listener>LoadBalancerPort"`
-	Protocol         string `xml:"Listener>Protocol"`
+	InstancePort     int64    `xml:"Listener>InstancePort"`
+	InstanceProtocol string   `xml:"Listener>InstanceProtocol"`
+	SSLCertificateId string   `xml:"Listener>SSLCertificateId"`
+	LoadBalancerPort int64    `xml:"Listener>LoadBalancerPort"`
+	Protocol         string   `xml:"Listener>Protocol"`
+	PolicyNames      []string `xml:"PolicyNames>member"`
 }
 
 // An Instance attaches to an elb
@@ -104,6 +129,37 @@ type Instance struct {
 	InstanceId string `xml:"InstanceId"`
 }
 
+// A BackendServerDescription holds the policies of an elb instance port
+type BackendServerDescription struct {
+	InstancePort int64    `xml:"InstancePort"`
+	PolicyNames  []string `xml:"PolicyNames>member"`
+}
+
+// The policies created on an elb, grouped by kind
+type Policies struct {
+	AppCookieStickinessPolicies []AppCookieStickinessPolicy `xml:"AppCookieStickinessPolicies>member"`
+	LBCookieStickinessPolicies  []LBCookieStickinessPolicy  `xml:"LBCookieStickinessPolicies>member"`
+	OtherPolicies               []string                    `xml:"OtherPolicies>member"`
+}
+
+// A stickiness policy following the lifetime of an application cookie
+type AppCookieStickinessPolicy struct {
+	PolicyName string `xml:"PolicyName"`
+	CookieName string `xml:"CookieName"`
+}
+
+// A stickiness policy with a cookie generated by the elb
+type LBCookieStickinessPolicy struct {
+	PolicyName             string `xml:"PolicyName"`
+	CookieExpirationPeriod int64  `xml:"CookieExpirationPeriod"`
+}
+
+// The security group the instances behind an elb receive traffic from
+type SourceSecurityGroup struct {
+	OwnerAlias string `xml:"OwnerAlias"`
+	GroupName  string `xml:"GroupName"`
+}
+
 // A tag attached to an elb
 type Tag struct {
 	Key   string `xml:"Key"`
@@ -118,6 +174,21 @@ type InstanceState struct {
 	ReasonCode  string `xml:"ReasonCode"`
 }
 
+// The states of an instance registered with an elb
+const (
+	StateInService    = "InService"
+	StateOutOfService = "OutOfService"
+	StateUnknown      = "Unknown"
+)
+
+// The reason codes of an InstanceState, telling whether a state is caused by
+// the elb or by the instance
+const (
+	ReasonCodeELB      = "ELB"
+	ReasonCodeInstance = "Instance"
+	ReasonCodeNA       = "N/A"
+)
+
 // ----------------------------------------------------------------------------
 // AddTags
 
@@ -194,8 +265,9 @@ type CreateLoadBalancer struct {
 }
 
 type CreateLoadBalancerResp struct {
-	DNSName   string `xml:"CreateLoadBalancerResult>DNSName"`
-	RequestId string `xml:"ResponseMetadata>RequestId"`
+	DNSName          string `xml:"CreateLoadBalancerResult>DNSName"`
+	HostedZoneNameID string `xml:"CreateLoadBalancerResult>CanonicalHostedZoneNameID"`
+	RequestId        string `xml:"ResponseMetadata>RequestId"`
 }
 
 func (elb *ELB) CreateLoadBalancer(options *CreateLoadBalancer) (resp *CreateLoadBalancerResp, err error) {
@@ -276,6 +348,88 @@ func (elb *ELB) CreateLoadBalancerListeners(options *CreateLoadBalancerListeners
 	return
 }
 
+// ----------------------------------------------------------------------------
+// DeleteListeners
+
+// The DeleteLoadBalancerListeners request parameters
+type DeleteLoadBalancerListeners struct {
+	LoadBalancerName  string
+	LoadBalancerPorts []int64
+}
+
+func (elb *ELB) DeleteLoadBalancerListeners(options *DeleteLoadBalancerListeners) (resp *SimpleResp, err error) {
+	params := makeParams("DeleteLoadBalancerListeners")
+
+	params["LoadBalancerName"] = options.LoadBalancerName
+
+	for i, v := range options.LoadBalancerPorts {
+		params["LoadBalancerPorts.member."+strconv.Itoa(i+1)] = strconv.FormatInt(v, 10)
+	}
+
+	resp = &SimpleResp{}
+
+	err = elb.query(params, resp)
+
+	if err != nil {
+		resp = nil
+	}
+
+	return
+}
+
+// EnsureListener makes listener the listener of the elb on its load balancer
+// port: it is created when the port has no listener, and replaces the
+// listener of the port when their configurations differ.
+func (elb *ELB) EnsureListener(lbName string, listener Listener) error {
+	resp, err := elb.DescribeLoadBalancers(&DescribeLoadBalancer{Names: []string{lbName}})
+	if err != nil {
+		return err
+	}
+	var lb *LoadBalancer
+	for i := range resp.LoadBalancers {
+		if resp.LoadBalancers[i].LoadBalancerName == lbName {
+			lb = &resp.LoadBalancers[i]
+			break
+		}
+	}
+	if lb == nil {
+		return fmt.Errorf("elb: load balancer %s not found", lbName)
+	}
+
+	for _, current := range lb.Listeners {
+		if current.LoadBalancerPort != listener.LoadBalancerPort {
+			continue
+		}
+		if sameListener(current, listener) {
+			return nil
+		}
+		_, err = elb.DeleteLoadBalancerListeners(&DeleteLoadBalancerListeners{
+			LoadBalancerName:  lbName,
+			LoadBalancerPorts: []int64{listener.LoadBalancerPort},
+		})
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	_, err = elb.CreateLoadBalancerListeners(&CreateLoadBalancerListeners{
+		LoadBalancerName: lbName,
+		Listeners:        []Listener{listener},
+	})
+	return err
+}
+
+// sameListener reports whether two listeners have the same configuration.
+// Protocols are compared regardless of case, as AWS does.
+func sameListener(a, b Listener) bool {
+	return a.LoadBalancerPort == b.LoadBalancerPort &&
+		a.InstancePort == b.InstancePort &&
+		strings.EqualFold(a.Protocol, b.Protocol) &&
+		strings.EqualFold(a.InstanceProtocol, b.InstanceProtocol) &&
+		a.SSLCertificateId == b.SSLCertificateId
+}
+
 // ----------------------------------------------------------------------------
 // SetSSLCertificate
 
@@ -332,27 +486,35 @@ func (elb *ELB) DeleteLoadBalancer(options *DeleteLoadBalancer) (resp *SimpleRes
 
 // An individual load balancer
 type LoadBalancer struct {
-	LoadBalancerName  string      `xml:"LoadBalancerName"`
-	Listeners         []Listener  `xml:"ListenerDescriptions>member"`
-	Instances         []Instance  `xml:"Instances>member"`
-	HealthCheck       HealthCheck `xml:"HealthCheck"`
-	AvailabilityZones []string    `xml:"AvailabilityZones>member"`
-	HostedZoneNameID  string      `xml:"CanonicalHostedZoneNameID"`
-	DNSName           string      `xml:"DNSName"`
-	SecurityGroups    []string    `xml:"SecurityGroups>member"`
-	Scheme            string      `xml:"Scheme"`
-	Subnets           []string    `xml:"Subnets>member"`
-	VPCId             string      `xml:"VPCId"`
+	LoadBalancerName          string                     `xml:"LoadBalancerName"`
+	Listeners                 []Listener                 `xml:"ListenerDescriptions>member"`
+	Instances                 []Instance                 `xml:"Instances>member"`
+	HealthCheck               HealthCheck                `xml:"HealthCheck"`
+	AvailabilityZones         []string                   `xml:"AvailabilityZones>member"`
+	HostedZoneNameID          string                     `xml:"CanonicalHostedZoneNameID"`
+	HostedZoneName            string                     `xml:"CanonicalHostedZoneName"`
+	DNSName                   string                     `xml:"DNSName"`
+	SecurityGroups            []string                   `xml:"SecurityGroups>member"`
+	Scheme                    string                     `xml:"Scheme"`
+	Subnets                   []string                   `xml:"Subnets>member"`
+	VPCId                     string                     `xml:"VPCId"`
+	SourceSecurityGroup       SourceSecurityGroup        `xml:"SourceSecurityGroup"`
+	Policies                  Policies                   `xml:"Policies"`
+	BackendServerDescriptions []BackendServerDescription `xml:"BackendServerDescriptions>member"`
+	CreatedTime               time.Time                  `xml:"CreatedTime"`
 }
 
 // DescribeLoadBalancer request params
 type DescribeLoadBalancer struct {
-	Names []string
+	Names    []string
+	Marker   string
+	PageSize int
 }
 
 type DescribeLoadBalancersResp struct {
 	RequestId     string         `xml:"ResponseMetadata>RequestId"`
 	LoadBalancers []LoadBalancer `xml:"DescribeLoadBalancersResult>LoadBalancerDescriptions>member"`
+	NextMarker    string         `xml:"DescribeLoadBalancersResult>NextMarker"`
 }
 
 func (elb *ELB) DescribeLoadBalancers(options *DescribeLoadBalancer) (resp *DescribeLoadBalancersResp, err error) {
@@ -361,6 +523,12 @@ func (elb *ELB) DescribeLoadBalancers(options *DescribeLoadBalancer) (resp *Desc
 	for i, v := range options.Names {
 		params["LoadBalancerNames.member."+strconv.Itoa(i+1)] = v
 	}
+	if options.Marker != "" {
+		params["Marker"] = options.Marker
+	}
+	if options.PageSize != 0 {
+		params["PageSize"] = strconv.Itoa(options.PageSize)
+	}
 
 	resp = &DescribeLoadBalancersResp{}
 
@@ -373,9 +541,34 @@ func (elb *ELB) DescribeLoadBalancers(options *DescribeLoadBalancer) (resp *Desc
 	return
 }
 
+// ListLoadBalancerNames returns the sorted names of all the load balancers,
+// following NextMarker through every page of DescribeLoadBalancers.
+func (elb *ELB) ListLoadBalancerNames() ([]string, error) {
+	var names []string
+	options := &DescribeLoadBalancer{}
+	for {
+		resp, err := elb.DescribeLoadBalancers(options)
+		if err != nil {
+			return nil, err
+		}
+		for _, lb := range resp.LoadBalancers {
+			names = append(names, lb.LoadBalancerName)
+		}
+		if resp.NextMarker == "" {
+			break
+		}
+		options.Marker = resp.NextMarker
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
 // ----------------------------------------------------------------------------
 // Attributes
 
+// AccessLog configures the delivery of access logs to an S3 bucket.
+// EmitInterval is the number of minutes between deliveries, either 5 or 60.
+// The bucket fields are kept but ignored while access logging is disabled.
 type AccessLog struct {
 	EmitInterval   int64
 	Enabled        bool
@@ -389,10 +582,10 @@ type ConnectionDraining struct {
 }
 
 type LoadBalancerAttributes struct {
-	CrossZoneLoadBalancingEnabled bool
-	ConnectionSettingsIdleTimeout int64
-	ConnectionDraining            ConnectionDraining
-	AccessLog                     AccessLog
+	CrossZoneLoadBalancingEnabled bool               `xml:"CrossZoneLoadBalancing>Enabled"`
+	ConnectionSettingsIdleTimeout int64              `xml:"ConnectionSettings>IdleTimeout"`
+	ConnectionDraining            ConnectionDraining `xml:"ConnectionDraining"`
+	AccessLog                     AccessLog          `xml:"AccessLog"`
 }
 
 type ModifyLoadBalancerAttributes struct {
@@ -414,7 +607,9 @@ func (elb *ELB) ModifyLoadBalancerAttributes(options *ModifyLoadBalancerAttribut
 	params["LoadBalancerAttributes.ConnectionDraining.Enabled"] = strconv.FormatBool(options.LoadBalancerAttributes.ConnectionDraining.Enabled)
 	params["LoadBalancerAttributes.AccessLog.Enabled"] = strconv.FormatBool(options.LoadBalancerAttributes.AccessLog.Enabled)
 	if options.LoadBalancerAttributes.AccessLog.Enabled {
-		params["LoadBalancerAttributes.AccessLog.EmitInterval"] = strconv.Itoa(int(options.LoadBalancerAttributes.AccessLog.EmitInterval))
+		if options.LoadBalancerAttributes.AccessLog.EmitInterval > 0 {
+			params["LoadBalancerAttributes.AccessLog.EmitInterval"] = strconv.Itoa(int(options.LoadBalancerAttributes.AccessLog.EmitInterval))
+		}
 		params["LoadBalancerAttributes.AccessLog.S3BucketName"] = options.LoadBalancerAttributes.AccessLog.S3BucketName
 		params["LoadBalancerAttributes.AccessLog.S3BucketPrefix"] = options.LoadBalancerAttributes.AccessLog.S3BucketPrefix
 	}
@@ -430,6 +625,31 @@ func (elb *ELB) ModifyLoadBalancerAttributes(options *ModifyLoadBalancerAttribut
 	return
 }
 
+type DescribeLoadBalancerAttributes struct {
+	LoadBalancerName string
+}
+
+type DescribeLoadBalancerAttributesResp struct {
+	RequestId              string                 `xml:"ResponseMetadata>RequestId"`
+	LoadBalancerAttributes LoadBalancerAttributes `xml:"DescribeLoadBalancerAttributesResult>LoadBalancerAttributes"`
+}
+
+func (elb *ELB) DescribeLoadBalancerAttributes(options *DescribeLoadBalancerAttributes) (resp *DescribeLoadBalancerAttributesResp, err error) {
+	params := makeParams("DescribeLoadBalancerAttributes")
+
+	params["LoadBalancerName"] = options.LoadBalancerName
+
+	resp = &DescribeLoadBalancerAttributesResp{}
+
+	err = elb.query(params, resp)
+
+	if err != nil {
+		resp = nil
+	}
+
+	return
+}
+
 // ----------------------------------------------------------------------------
 // Instance Registration / deregistration
 
@@ -495,6 +715,116 @@ func (elb *ELB) DeregisterInstancesFromLoadBalancer(options *DeregisterInstances
 	return
 }
 
+// defaultRegisterBatchSize is the number of instances RegisterInstancesBatched
+// registers per call when not told otherwise.
+const defaultRegisterBatchSize = 100
+
+// A RegisterBatchError is returned by RegisterInstancesBatched when a batch
+// fails to register. The batches before it are registered, the ones after it
+// aren't attempted.
+type RegisterBatchError struct {
+	Batch       int      // The index of the failed batch, from 0
+	InstanceIds []string // The instances of the failed batch
+	Err         error
+}
+
+func (e *RegisterBatchError) Error() string {
+	return fmt.Sprintf("elb: registering batch %d of %d instances: %v", e.Batch, len(e.InstanceIds), e.Err)
+}
+
+// Unwrap returns the error the batch failed with.
+func (e *RegisterBatchError) Unwrap() error {
+	return e.Err
+}
+
+// RegisterInstancesBatched registers instanceIds with the elb, calling
+// RegisterInstancesWithLoadBalancer with at most batchSize instances at a
+// time. A batchSize of 0 or less registers them in batches of 100.
+func (elb *ELB) RegisterInstancesBatched(lbName string, instanceIds []string, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = defaultRegisterBatchSize
+	}
+	for batch := 0; batch*batchSize < len(instanceIds); batch++ {
+		ids := instanceIds[batch*batchSize:]
+		if len(ids) > batchSize {
+			ids = ids[:batchSize]
+		}
+		_, err := elb.RegisterInstancesWithLoadBalancer(&RegisterInstancesWithLoadBalancer{
+			LoadBalancerName: lbName,
+			Instances:        ids,
+		})
+		if err != nil {
+			return &RegisterBatchError{Batch: batch, InstanceIds: ids, Err: err}
+		}
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Availability Zones
+
+// The EnableAvailabilityZonesForLoadBalancer request parameters
+type EnableAvailabilityZonesForLoadBalancer struct {
+	LoadBalancerName  string
+	AvailabilityZones []string
+}
+
+type EnableAvailabilityZonesForLoadBalancerResp struct {
+	AvailabilityZones []string `xml:"EnableAvailabilityZonesForLoadBalancerResult>AvailabilityZones>member"`
+	RequestId         string   `xml:"ResponseMetadata>RequestId"`
+}
+
+func (elb *ELB) EnableAvailabilityZonesForLoadBalancer(options *EnableAvailabilityZonesForLoadBalancer) (resp *EnableAvailabilityZonesForLoadBalancerResp, err error) {
+	params := makeParams("EnableAvailabilityZonesForLoadBalancer")
+
+	params["LoadBalancerName"] = options.LoadBalancerName
+
+	for i, v := range options.AvailabilityZones {
+		params["AvailabilityZones.member."+strconv.Itoa(i+1)] = v
+	}
+
+	resp = &EnableAvailabilityZonesForLoadBalancerResp{}
+
+	err = elb.query(params, resp)
+
+	if err != nil {
+		resp = nil
+	}
+
+	return
+}
+
+// The DisableAvailabilityZonesForLoadBalancer request parameters
+type DisableAvailabilityZonesForLoadBalancer struct {
+	LoadBalancerName  string
+	AvailabilityZones []string
+}
+
+type DisableAvailabilityZonesForLoadBalancerResp struct {
+	AvailabilityZones []string `xml:"DisableAvailabilityZonesForLoadBalancerResult>AvailabilityZones>member"`
+	RequestId         string   `xml:"ResponseMetadata>RequestId"`
+}
+
+func (elb *ELB) DisableAvailabilityZonesForLoadBalancer(options *DisableAvailabilityZonesForLoadBalancer) (resp *DisableAvailabilityZonesForLoadBalancerResp, err error) {
+	params := makeParams("DisableAvailabilityZonesForLoadBalancer")
+
+	params["LoadBalancerName"] = options.LoadBalancerName
+
+	for i, v := range options.AvailabilityZones {
+		params["AvailabilityZones.member."+strconv.Itoa(i+1)] = v
+	}
+
+	resp = &DisableAvailabilityZonesForLoadBalancerResp{}
+
+	err = elb.query(params, resp)
+
+	if err != nil {
+		resp = nil
+	}
+
+	return
+}
+
 // ----------------------------------------------------------------------------
 // DescribeTags
 
@@ -573,12 +903,226 @@ func (elb *ELB) ConfigureHealthCheck(options *ConfigureHealthCheck) (resp *Confi
 	return
 }
 
+// ----------------------------------------------------------------------------
+// Policies
+
+// A PolicyAttribute configures a load balancer policy
+type PolicyAttribute struct {
+	AttributeName  string `xml:"AttributeName"`
+	AttributeValue string `xml:"AttributeValue"`
+}
+
+// A PolicyAttributeType describes an attribute accepted by a policy type
+type PolicyAttributeType struct {
+	AttributeName string `xml:"AttributeName"`
+	AttributeType string `xml:"AttributeType"`
+	Cardinality   string `xml:"Cardinality"`
+	DefaultValue  string `xml:"DefaultValue"`
+	Description   string `xml:"Description"`
+}
+
+// A PolicyType from which load balancer policies are created
+type PolicyType struct {
+	PolicyTypeName       string                `xml:"PolicyTypeName"`
+	Description          string                `xml:"Description"`
+	PolicyAttributeTypes []PolicyAttributeType `xml:"PolicyAttributeTypeDescriptions>member"`
+}
+
+// A Policy created on an elb
+type Policy struct {
+	PolicyName       string            `xml:"PolicyName"`
+	PolicyTypeName   string            `xml:"PolicyTypeName"`
+	PolicyAttributes []PolicyAttribute `xml:"PolicyAttributeDescriptions>member"`
+}
+
+// The DescribeLoadBalancerPolicyTypes request parameters
+type DescribeLoadBalancerPolicyTypes struct {
+	PolicyTypeNames []string
+}
+
+type DescribeLoadBalancerPolicyTypesResp struct {
+	PolicyTypes []PolicyType `xml:"DescribeLoadBalancerPolicyTypesResult>PolicyTypeDescriptions>member"`
+	RequestId   string       `xml:"ResponseMetadata>RequestId"`
+}
+
+func (elb *ELB) DescribeLoadBalancerPolicyTypes(options *DescribeLoadBalancerPolicyTypes) (resp *DescribeLoadBalancerPolicyTypesResp, err error) {
+	params := makeParams("DescribeLoadBalancerPolicyTypes")
+
+	for i, v := range options.PolicyTypeNames {
+		params["PolicyTypeNames.member."+strconv.Itoa(i+1)] = v
+	}
+
+	resp = &DescribeLoadBalancerPolicyTypesResp{}
+
+	err = elb.query(params, resp)
+
+	if err != nil {
+		resp = nil
+	}
+
+	return
+}
+
+// The CreateLoadBalancerPolicy request parameters
+type CreateLoadBalancerPolicy struct {
+	LoadBalancerName string
+	PolicyName       string
+	PolicyTypeName   string
+	PolicyAttributes []PolicyAttribute
+}
+
+func (elb *ELB) CreateLoadBalancerPolicy(options *CreateLoadBalancerPolicy) (resp *SimpleResp, err error) {
+	params := makeParams("CreateLoadBalancerPolicy")
+
+	params["LoadBalancerName"] = options.LoadBalancerName
+	params["PolicyName"] = options.PolicyName
+	params["PolicyTypeName"] = options.PolicyTypeName
+
+	for i, v := range options.PolicyAttributes {
+		params["PolicyAttributes.member."+strconv.Itoa(i+1)+".AttributeName"] = v.AttributeName
+		params["PolicyAttributes.member."+strconv.Itoa(i+1)+".AttributeValue"] = v.AttributeValue
+	}
+
+	resp = &SimpleResp{}
+
+	err = elb.query(params, resp)
+
+	if err != nil {
+		resp = nil
+	}
+
+	return
+}
+
+// The DeleteLoadBalancerPolicy request parameters
+type DeleteLoadBalancerPolicy struct {
+	LoadBalancerName string
+	PolicyName       string
+}
+
+func (elb *ELB) DeleteLoadBalancerPolicy(options *DeleteLoadBalancerPolicy) (resp *SimpleResp, err error) {
+	params := makeParams("DeleteLoadBalancerPolicy")
+
+	params["LoadBalancerName"] = options.LoadBalancerName
+	params["PolicyName"] = options.PolicyName
+
+	resp = &SimpleResp{}
+
+	err = elb.query(params, resp)
+
+	if err != nil {
+		resp = nil
+	}
+
+	return
+}
+
+// The DescribeLoadBalancerPolicies request parameters
+type DescribeLoadBalancerPolicies struct {
+	LoadBalancerName string
+	PolicyNames      []string
+}
+
+type DescribeLoadBalancerPoliciesResp struct {
+	Policies  []Policy `xml:"DescribeLoadBalancerPoliciesResult>PolicyDescriptions>member"`
+	RequestId string   `xml:"ResponseMetadata>RequestId"`
+}
+
+func (elb *ELB) DescribeLoadBalancerPolicies(options *DescribeLoadBalancerPolicies) (resp *DescribeLoadBalancerPoliciesResp, err error) {
+	params := makeParams("DescribeLoadBalancerPolicies")
+
+	params["LoadBalancerName"] = options.LoadBalancerName
+
+	for i, v := range options.PolicyNames {
+		params["PolicyNames.member."+strconv.Itoa(i+1)] = v
+	}
+
+	resp = &DescribeLoadBalancerPoliciesResp{}
+
+	err = elb.query(params, resp)
+
+	if err != nil {
+		resp = nil
+	}
+
+	return
+}
+
+// The SetLoadBalancerPoliciesOfListener request parameters
+//
+// An empty PolicyNames removes all policies from the listener.
+type SetLoadBalancerPoliciesOfListener struct {
+	LoadBalancerName string
+	LoadBalancerPort int64
+	PolicyNames      []string
+}
+
+func (elb *ELB) SetLoadBalancerPoliciesOfListener(options *SetLoadBalancerPoliciesOfListener) (resp *SimpleResp, err error) {
+	params := makeParams("SetLoadBalancerPoliciesOfListener")
+
+	params["LoadBalancerName"] = options.LoadBalancerName
+	params["LoadBalancerPort"] = strconv.FormatInt(options.LoadBalancerPort, 10)
+
+	if len(options.PolicyNames) == 0 {
+		params["PolicyNames"] = ""
+	}
+	for i, v := range options.PolicyNames {
+		params["PolicyNames.member."+strconv.Itoa(i+1)] = v
+	}
+
+	resp = &SimpleResp{}
+
+	err = elb.query(params, resp)
+
+	if err != nil {
+		resp = nil
+	}
+
+	return
+}
+
+// The SetLoadBalancerPoliciesForBackendServer request parameters
+//
+// An empty PolicyNames removes all policies from the instance port.
+type SetLoadBalancerPoliciesForBackendServer struct {
+	LoadBalancerName string
+	InstancePort     int64
+	PolicyNames      []string
+}
+
+func (elb *ELB) SetLoadBalancerPoliciesForBackendServer(options *SetLoadBalancerPoliciesForBackendServer) (resp *SimpleResp, err error) {
+	params := makeParams("SetLoadBalancerPoliciesForBackendServer")
+
+	params["LoadBalancerName"] = options.LoadBalancerName
+	params["InstancePort"] = strconv.FormatInt(options.InstancePort, 10)
+
+	if len(options.PolicyNames) == 0 {
+		params["PolicyNames"] = ""
+	}
+	for i, v := range options.PolicyNames {
+		params["PolicyNames.member."+strconv.Itoa(i+1)] = v
+	}
+
+	resp = &SimpleResp{}
+
+	err = elb.query(params, resp)
+
+	if err != nil {
+		resp = nil
+	}
+
+	return
+}
+
 // ----------------------------------------------------------------------------
 // Instance Health
 
 // The DescribeInstanceHealth request parameters
+//
+// When Instances is set, only the health of those instances is described.
 type DescribeInstanceHealth struct {
 	LoadBalancerName string
+	Instances        []string
 }
 
 type DescribeInstanceHealthResp struct {
@@ -591,6 +1135,10 @@ func (elb *ELB) DescribeInstanceHealth(options *DescribeInstanceHealth) (resp *D
 
 	params["LoadBalancerName"] = options.LoadBalancerName
 
+	for i, v := range options.Instances {
+		params["Instances.member."+strconv.Itoa(i+1)+".InstanceId"] = v
+	}
+
 	resp = &DescribeInstanceHealthResp{}
 
 	err = elb.query(params, resp)
@@ -602,6 +1150,40 @@ func (elb *ELB) DescribeInstanceHealth(options *DescribeInstanceHealth) (resp *D
 	return
 }
 
+// HealthSummary counts the instances of an elb in each state
+type HealthSummary struct {
+	InService    int
+	OutOfService int
+	Unknown      int
+
+	// AllInService is true when the elb has instances and all of them are
+	// InService.
+	AllInService bool
+}
+
+// InstanceHealthSummary describes the health of the instances of an elb and
+// counts them by state.
+func (elb *ELB) InstanceHealthSummary(lbName string) (summary HealthSummary, err error) {
+	resp, err := elb.DescribeInstanceHealth(&DescribeInstanceHealth{LoadBalancerName: lbName})
+	if err != nil {
+		return
+	}
+
+	for _, state := range resp.InstanceStates {
+		switch state.State {
+		case StateInService:
+			summary.InService++
+		case StateOutOfService:
+			summary.OutOfService++
+		default:
+			summary.Unknown++
+		}
+	}
+	summary.AllInService = summary.InService > 0 && summary.InService == len(resp.InstanceStates)
+
+	return
+}
+
 // Responses
 
 type SimpleResp struct {
@@ -609,7 +1191,8 @@ type SimpleResp struct {
 }
 
 type xmlErrors struct {
-	Errors []Error `xml:"Error"`
+	Errors    []Error `xml:"Error"`
+	RequestId string  `xml:"RequestId"`
 }
 
 // Error encapsulates an elb error.
@@ -622,6 +1205,9 @@ type Error struct {
 
 	// Message explaining the error.
 	Message string
+
+	// AWS request id of the failed request, needed when contacting support.
+	RequestId string
 }
 
 func (e *Error) Error() string {
@@ -632,5 +1218,46 @@ func (e *Error) Error() string {
 	if prefix == "" && e.StatusCode > 0 {
 		prefix = strconv.Itoa(e.StatusCode) + ": "
 	}
+	if e.RequestId != "" {
+		return prefix + e.Message + " (RequestId: " + e.RequestId + ")"
+	}
 	return prefix + e.Message
 }
+
+// IsThrottling reports whether the request was throttled and may be retried
+// later.
+func (e *Error) IsThrottling() bool {
+	switch e.Code {
+	case "Throttling", "ThrottlingException", "RequestLimitExceeded":
+		return true
+	}
+	return false
+}
+
+// IsNotFound reports whether the load balancer, listener or policy the
+// request refers to does not exist.
+func (e *Error) IsNotFound() bool {
+	switch e.Code {
+	case "LoadBalancerNotFound", "AccessPointNotFound", "ListenerNotFound", "PolicyNotFound", "PolicyTypeNotFound":
+		return true
+	}
+	return false
+}
+
+// IsValidation reports whether the request was rejected for having invalid
+// parameters.
+func (e *Error) IsValidation() bool {
+	switch e.Code {
+	case "ValidationError", "InvalidParameterValue", "InvalidParameterCombination":
+		return true
+	}
+	return false
+}
+
+// AsError returns the first *Error in the chain of err, as unwrapped by
+// errors.As, if there is one.
+func AsError(err error) (*Error, bool) {
+	var e *Error
+	ok := errors.As(err, &e)
+	return e, ok
+}
@@ -0,0 +1,134 @@
+package elb_test
+
+import (
+	"testing"
+
+	"github.com/pivotal-cloudops/cloudops-goamz/aws"
+	"github.com/pivotal-cloudops/cloudops-goamz/elb"
+	"github.com/pivotal-cloudops/cloudops-goamz/elb/elbtest"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct {
+	srv *elbtest.Server
+	elb *elb.ELB
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpTest(c *C) {
+	srv, err := elbtest.NewServer()
+	c.Assert(err, IsNil)
+	s.srv = srv
+	s.elb = elb.New(aws.Auth{AccessKey: "key", SecretKey: "secret"}, aws.Region{ELBEndpoint: srv.URL()})
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.srv.Quit()
+}
+
+var httpListener = elb.Listener{
+	InstancePort:     80,
+	InstanceProtocol: "HTTP",
+	LoadBalancerPort: 80,
+	Protocol:         "HTTP",
+}
+
+func (s *S) createLoadBalancer(c *C, name string) {
+	_, err := s.elb.CreateLoadBalancer(&elb.CreateLoadBalancer{
+		LoadBalancerName: name,
+		AvailZone:        []string{"us-east-1a"},
+		Listeners:        []elb.Listener{httpListener},
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestErrorPredicates(c *C) {
+	_, err := s.elb.DescribeLoadBalancers(&elb.DescribeLoadBalancer{Names: []string{"unknown"}})
+	e, ok := elb.AsError(err)
+	c.Assert(ok, Equals, true)
+	c.Assert(e.IsNotFound(), Equals, true)
+	c.Assert(e.IsThrottling(), Equals, false)
+
+	s.srv.SetFailureRate("DescribeLoadBalancers", 1)
+	_, err = s.elb.DescribeLoadBalancers(&elb.DescribeLoadBalancer{})
+	e, ok = elb.AsError(err)
+	c.Assert(ok, Equals, true)
+	c.Assert(e.IsThrottling(), Equals, true)
+
+	_, err = s.elb.CreateLoadBalancer(&elb.CreateLoadBalancer{LoadBalancerName: "testlb"})
+	e, ok = elb.AsError(err)
+	c.Assert(ok, Equals, true)
+	c.Assert(e.IsValidation(), Equals, true)
+}
+
+func (s *S) TestRegisterInstancesBatched(c *C) {
+	s.createLoadBalancer(c, "testlb")
+	var instIds []string
+	for i := 0; i < 5; i++ {
+		instIds = append(instIds, s.srv.NewInstance())
+	}
+	err := s.elb.RegisterInstancesBatched("testlb", instIds, 2)
+	c.Assert(err, IsNil)
+	c.Assert(s.srv.RegisteredInstances("testlb"), HasLen, 5)
+	c.Assert(s.srv.Operations()[1:], DeepEquals, []string{
+		"RegisterInstancesWithLoadBalancer",
+		"RegisterInstancesWithLoadBalancer",
+		"RegisterInstancesWithLoadBalancer",
+	})
+}
+
+func (s *S) TestRegisterInstancesBatchedFailure(c *C) {
+	s.createLoadBalancer(c, "testlb")
+	instIds := []string{s.srv.NewInstance(), s.srv.NewInstance(), "i-999"}
+	err := s.elb.RegisterInstancesBatched("testlb", instIds, 2)
+	batchErr, ok := err.(*elb.RegisterBatchError)
+	c.Assert(ok, Equals, true)
+	c.Assert(batchErr.Batch, Equals, 1)
+	c.Assert(batchErr.InstanceIds, DeepEquals, []string{"i-999"})
+	c.Assert(s.srv.RegisteredInstances("testlb"), DeepEquals, instIds[:2])
+	e, ok := elb.AsError(err)
+	c.Assert(ok, Equals, true)
+	c.Assert(e.Code, Equals, "InvalidInstance")
+}
+
+func (s *S) TestEnsureListener(c *C) {
+	s.createLoadBalancer(c, "testlb")
+	s.createLoadBalancer(c, "testlb2")
+	c.Assert(s.elb.EnsureListener("testlb", httpListener), IsNil)
+	c.Assert(s.srv.Operations()[2:], DeepEquals, []string{"DescribeLoadBalancers"})
+
+	tcp := elb.Listener{InstancePort: 8080, InstanceProtocol: "TCP", LoadBalancerPort: 80, Protocol: "TCP"}
+	c.Assert(s.elb.EnsureListener("testlb", tcp), IsNil)
+	resp, err := s.elb.DescribeLoadBalancers(&elb.DescribeLoadBalancer{Names: []string{"testlb", "testlb2"}})
+	c.Assert(err, IsNil)
+	c.Assert(resp.LoadBalancers, HasLen, 2)
+	for _, lb := range resp.LoadBalancers {
+		c.Assert(lb.Listeners, HasLen, 1)
+		if lb.LoadBalancerName == "testlb" {
+			c.Assert(lb.Listeners[0].InstancePort, Equals, int64(8080))
+		} else {
+			c.Assert(lb.Listeners[0].InstancePort, Equals, int64(80))
+		}
+	}
+
+	c.Assert(s.elb.EnsureListener("unknown", tcp), NotNil)
+}
+
+func (s *S) TestListLoadBalancerNames(c *C) {
+	srv, err := elbtest.NewServerWithOptions(elbtest.ServerOptions{PageSize: 2})
+	c.Assert(err, IsNil)
+	defer srv.Quit()
+	client := elb.New(aws.Auth{AccessKey: "key", SecretKey: "secret"}, aws.Region{ELBEndpoint: srv.URL()})
+	for _, name := range []string{"lb-c", "lb-a", "lb-e", "lb-b", "lb-d"} {
+		srv.NewLoadBalancer(name)
+	}
+	names, err := client.ListLoadBalancerNames()
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"lb-a", "lb-b", "lb-c", "lb-d", "lb-e"})
+	c.Assert(srv.Operations(), HasLen, 3)
+}
@@ -4,15 +4,24 @@
 package elbtest
 
 import (
+	"bytes"
+	"crypto/x509"
 	"encoding/xml"
 	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pivotal-cloudops/cloudops-goamz/elb"
 )
@@ -21,33 +30,158 @@ import (
 type Server struct {
 	url            string
 	listener       net.Listener
+	certPool       *x509.CertPool
+	ready          chan struct{}
+	options        ServerOptions
 	mutex          sync.Mutex
 	reqId          int
 	lbs            map[string]*elb.LoadBalancer
 	lbsReqs        map[string]url.Values
 	instances      []string
+	instanceZones  map[string]string
 	instanceStates map[string][]*elb.InstanceState
+	defaultState   *elb.InstanceState
+	stateScripts   map[string]map[string][]elb.InstanceState
 	instCount      int
 	lbTags         map[string][]elb.Tag
+	lbPolicies     map[string][]elb.Policy
+	lbAttrs        map[string]elb.LoadBalancerAttributes
+	healthChecks   map[string]bool
+	strict         bool
+	idempotent     bool
+	failureRates   map[string]float64
+	rawResponses   map[string]rawResponse
+	limits         map[string]int
+	describeDelay  int
+	unconverged    map[string]int
+	rand           *rand.Rand
+	operations     []string
+	operationForms []url.Values
+	onRequest      func(*http.Request)
+	authError      *elb.Error
+	logf           func(format string, args ...interface{})
+}
+
+// ServerOptions configures a server started by NewServerWithOptions. The zero
+// value starts the same server as NewServer.
+type ServerOptions struct {
+	// Region is the region load balancers created through the API are in,
+	// as shown by their DNS names and hosted zone name ids. It defaults to
+	// us-east-1.
+	Region string
+	// DNSSuffix ends the DNS names of load balancers created through the API.
+	// It defaults to elb.amazonaws.com.
+	DNSSuffix string
+	// PageSize is the number of load balancers DescribeLoadBalancers returns
+	// per page when the request doesn't give a PageSize. It defaults to, and
+	// is capped at, 400.
+	PageSize int
+	// EventualConsistency is the number of DescribeLoadBalancers calls new
+	// load balancers are hidden from, as set by SetEventualConsistency. It
+	// defaults to 0.
+	EventualConsistency int
+	// Logger logs unknown actions and server errors, as set by SetLogger. By
+	// default they are discarded.
+	Logger func(format string, args ...interface{})
+	// StrictListeners and IdempotentCreate are set as by SetStrictListeners
+	// and SetIdempotentCreate. Both default to false.
+	StrictListeners  bool
+	IdempotentCreate bool
+	// TLS makes the server serve HTTPS, as NewTLSServer does. It defaults to
+	// false.
+	TLS bool
 }
 
 // Starts and returns a new server
 func NewServer() (*Server, error) {
+	return NewServerWithOptions(ServerOptions{})
+}
+
+// Starts and returns a new server configured by opts
+//
+// Reset returns the server to the configuration given by opts.
+func NewServerWithOptions(opts ServerOptions) (*Server, error) {
+	if opts.TLS {
+		return newTLSServer(opts), nil
+	}
 	l, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		return nil, fmt.Errorf("cannot listen on localhost: %v", err)
 	}
-	srv := &Server{
-		listener:       l,
-		url:            "http://" + l.Addr().String(),
+	return newServerWithListener(l, opts), nil
+}
+
+// Starts and returns a new server serving on l
+func NewServerWithListener(l net.Listener) *Server {
+	return newServerWithListener(l, ServerOptions{})
+}
+
+func newServerWithListener(l net.Listener, opts ServerOptions) *Server {
+	srv := newServer(opts)
+	srv.listener = l
+	srv.url = "http://" + l.Addr().String()
+	go http.Serve(&readyListener{Listener: l, ready: srv.ready}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		srv.serveHTTP(w, req)
+	}))
+	return srv
+}
+
+// Starts and returns a new server serving HTTPS with a self-signed certificate
+//
+// Clients trust the server through the pool returned by CertPool.
+func NewTLSServer() (*Server, error) {
+	return newTLSServer(ServerOptions{}), nil
+}
+
+func newTLSServer(opts ServerOptions) *Server {
+	srv := newServer(opts)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		srv.serveHTTP(w, req)
+	}))
+	ts.Listener = &readyListener{Listener: ts.Listener, ready: srv.ready}
+	ts.StartTLS()
+	srv.listener = ts.Listener
+	srv.url = ts.URL
+	srv.certPool = x509.NewCertPool()
+	srv.certPool.AddCert(ts.Certificate())
+	return srv
+}
+
+func newServer(opts ServerOptions) *Server {
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.DNSSuffix == "" {
+		opts.DNSSuffix = "elb.amazonaws.com"
+	}
+	if opts.PageSize <= 0 || opts.PageSize > maxPageSize {
+		opts.PageSize = maxPageSize
+	}
+	logf := opts.Logger
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	return &Server{
+		ready:          make(chan struct{}),
+		options:        opts,
+		strict:         opts.StrictListeners,
+		idempotent:     opts.IdempotentCreate,
+		describeDelay:  opts.EventualConsistency,
 		lbs:            make(map[string]*elb.LoadBalancer),
 		instanceStates: make(map[string][]*elb.InstanceState),
+		stateScripts:   make(map[string]map[string][]elb.InstanceState),
+		instanceZones:  make(map[string]string),
 		lbTags:         make(map[string][]elb.Tag),
+		lbPolicies:     make(map[string][]elb.Policy),
+		lbAttrs:        make(map[string]elb.LoadBalancerAttributes),
+		healthChecks:   make(map[string]bool),
+		failureRates:   make(map[string]float64),
+		rawResponses:   make(map[string]rawResponse),
+		limits:         make(map[string]int),
+		unconverged:    make(map[string]int),
+		rand:           rand.New(rand.NewSource(1)),
+		logf:           logf,
 	}
-	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		srv.serveHTTP(w, req)
-	}))
-	return srv, nil
 }
 
 // Quit closes down the server.
@@ -55,52 +189,457 @@ func (srv *Server) Quit() {
 	srv.listener.Close()
 }
 
+// Ready returns a channel that is closed once the server is accepting
+// connections. The server also answers GET /ping with 200 OK, without
+// recording an operation or using up a request id.
+func (srv *Server) Ready() <-chan struct{} {
+	return srv.ready
+}
+
+// readyListener closes ready the first time the server accepts a connection
+// from it.
+type readyListener struct {
+	net.Listener
+	once  sync.Once
+	ready chan struct{}
+}
+
+func (l *readyListener) Accept() (net.Conn, error) {
+	l.once.Do(func() { close(l.ready) })
+	return l.Listener.Accept()
+}
+
 // URL returns the URL of the server.
 func (srv *Server) URL() string {
 	return srv.url
 }
 
+// CertPool returns a pool trusting the certificate of a server started with
+// NewTLSServer, or nil for other servers.
+func (srv *Server) CertPool() *x509.CertPool {
+	return srv.certPool
+}
+
+// Reset discards the load balancers, instances, recorded operations and
+// injected failures of the server, and restarts its request ids, leaving it
+// as newly started with the options it was started with. The logger and
+// OnRequest hook are kept.
+func (srv *Server) Reset() {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.reqId = 0
+	srv.lbs = make(map[string]*elb.LoadBalancer)
+	srv.lbsReqs = nil
+	srv.instances = nil
+	srv.instanceZones = make(map[string]string)
+	srv.instanceStates = make(map[string][]*elb.InstanceState)
+	srv.stateScripts = make(map[string]map[string][]elb.InstanceState)
+	srv.defaultState = nil
+	srv.instCount = 0
+	srv.lbTags = make(map[string][]elb.Tag)
+	srv.lbPolicies = make(map[string][]elb.Policy)
+	srv.lbAttrs = make(map[string]elb.LoadBalancerAttributes)
+	srv.healthChecks = make(map[string]bool)
+	srv.strict = srv.options.StrictListeners
+	srv.idempotent = srv.options.IdempotentCreate
+	srv.failureRates = make(map[string]float64)
+	srv.rawResponses = make(map[string]rawResponse)
+	srv.authError = nil
+	srv.limits = make(map[string]int)
+	srv.describeDelay = srv.options.EventualConsistency
+	srv.unconverged = make(map[string]int)
+	srv.rand = rand.New(rand.NewSource(1))
+	srv.operations = nil
+	srv.operationForms = nil
+}
+
+// SetLogger sets the function used to log unknown actions and server errors.
+// The default, or a nil logf, discards them.
+func (srv *Server) SetLogger(logf func(format string, args ...interface{})) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	srv.logf = logf
+}
+
+// OnRequest sets a function called with every request the server receives,
+// before it is dispatched, so tests can capture or check anything about it.
+// It is called with the server locked, after its form has been parsed, so f
+// must not call the methods of the server, which would deadlock. A nil f
+// removes the hook.
+func (srv *Server) OnRequest(f func(*http.Request)) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.onRequest = f
+}
+
+// SetStrictListeners sets whether DeleteLoadBalancerListeners refuses to
+// remove the last listener of a load balancer. It is off by default.
+func (srv *Server) SetStrictListeners(strict bool) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.strict = strict
+}
+
+// SetDefaultInstanceState sets the state given to instances when they are
+// registered with a load balancer. The InstanceId of state is replaced by the
+// id of each instance. By default instances start OutOfService, as on AWS.
+func (srv *Server) SetDefaultInstanceState(state elb.InstanceState) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.defaultState = &state
+}
+
+// SetIdempotentCreate sets whether CreateLoadBalancer succeeds, returning
+// the existing load balancer, when asked to create a load balancer that
+// already exists with the same listeners, zones, subnets and scheme. It is
+// off by default, and creating an existing load balancer fails with
+// DuplicateLoadBalancerName whatever its configuration.
+func (srv *Server) SetIdempotentCreate(idempotent bool) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.idempotent = idempotent
+}
+
+// SetEventualConsistency makes the first n DescribeLoadBalancers calls after
+// a load balancer is created through the API behave as if it didn't exist
+// yet: it is left out of listings, and asking for it by name fails with
+// LoadBalancerNotFound. An n of 0, the default, disables it.
+func (srv *Server) SetEventualConsistency(n int) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.describeDelay = n
+}
+
+// converge counts a DescribeLoadBalancers call against the load balancers
+// that are still invisible to it, and returns those load balancers.
+func (srv *Server) converge() map[string]bool {
+	hidden := make(map[string]bool)
+	for name, n := range srv.unconverged {
+		hidden[name] = true
+		if n <= 1 {
+			delete(srv.unconverged, name)
+		} else {
+			srv.unconverged[name] = n - 1
+		}
+	}
+	return hidden
+}
+
+// The service limits the server can enforce
+const (
+	LimitListenersPerLB = "listeners-per-lb"
+	LimitLBsPerAccount  = "lbs-per-account"
+)
+
+// SetLimit sets the service limit name, one of the Limit constants, to n.
+// No limit is set by default, and a zero or negative n removes the limit.
+func (srv *Server) SetLimit(name string, n int) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if n <= 0 {
+		delete(srv.limits, name)
+		return
+	}
+	srv.limits[name] = n
+}
+
+// exceedsLimit reports whether n exceeds the limit name.
+func (srv *Server) exceedsLimit(name string, n int) bool {
+	limit, ok := srv.limits[name]
+	return ok && n > limit
+}
+
+// tooManyListeners is the error for a load balancer given more listeners
+// than LimitListenersPerLB allows.
+func (srv *Server) tooManyListeners(lbName string) error {
+	return &elb.Error{
+		StatusCode: 400,
+		Code:       "ValidationError",
+		Message:    fmt.Sprintf("Load balancer %s cannot have more than %d listeners.", lbName, srv.limits[LimitListenersPerLB]),
+	}
+}
+
+// Operations returns a copy of the actions the server has been asked to carry
+// out, in the order they were accepted, even when served concurrently.
+func (srv *Server) Operations() []string {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return append([]string(nil), srv.operations...)
+}
+
+// A TagOperation is an AddTags or RemoveTags call recorded by the server.
+type TagOperation struct {
+	Action string
+	// Tags are the tags added, or the keys of the tags removed, whose
+	// Values are then empty.
+	Tags []elb.Tag
+}
+
+// TagOperations returns the AddTags and RemoveTags calls the server has been
+// asked to carry out on the named load balancer, in the order they were
+// received.
+func (srv *Server) TagOperations(lbName string) []TagOperation {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	ops := []TagOperation{}
+	for i, action := range srv.operations {
+		if action != "AddTags" && action != "RemoveTags" {
+			continue
+		}
+		form := srv.operationForms[i]
+		if !containsString(srv.getParameters("LoadBalancerNames.member.", form), lbName) {
+			continue
+		}
+		ops = append(ops, TagOperation{Action: action, Tags: makeTags(form)})
+	}
+	return ops
+}
+
+// AssertOperations returns an error describing the first difference between
+// the actions the server has carried out and expected, if any.
+func (srv *Server) AssertOperations(expected []string) error {
+	got := srv.Operations()
+	for i := 0; i < len(got) || i < len(expected); i++ {
+		switch {
+		case i >= len(got):
+			return fmt.Errorf("missing operations %v, got %v", expected[i:], got)
+		case i >= len(expected):
+			return fmt.Errorf("unexpected operations %v, got %v", got[i:], got)
+		case got[i] != expected[i]:
+			return fmt.Errorf("operation %d is %s, expected %s, got %v", i, got[i], expected[i], got)
+		}
+	}
+	return nil
+}
+
+// SetFailureRate makes the given action fail with a Throttling error on a
+// pseudo-random fraction of calls. A rate of zero disables failures.
+func (srv *Server) SetFailureRate(action string, rate float64) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if rate <= 0 {
+		delete(srv.failureRates, action)
+		return
+	}
+	srv.failureRates[action] = rate
+}
+
+// SetAuthError makes every request fail with err before it is dispatched, as
+// AWS rejects requests signed with bad credentials, such as with
+// InvalidClientTokenId or SignatureDoesNotMatch. A nil err clears it.
+func (srv *Server) SetAuthError(err *elb.Error) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.authError = err
+}
+
+// SetRawResponse makes the server answer every request for action with the
+// given status, body and content type instead of handling it, so clients can
+// be tested against malformed responses. A zero status removes the response.
+func (srv *Server) SetRawResponse(action string, status int, body []byte, contentType string) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if status == 0 {
+		delete(srv.rawResponses, action)
+		return
+	}
+	srv.rawResponses[action] = rawResponse{status, append([]byte(nil), body...), contentType}
+}
+
+// A rawResponse is written verbatim in place of the response to an action.
+type rawResponse struct {
+	status      int
+	body        []byte
+	contentType string
+}
+
+// write writes the response to w.
+func (r rawResponse) write(w http.ResponseWriter) {
+	if r.contentType != "" {
+		w.Header().Set("Content-Type", r.contentType)
+	}
+	w.WriteHeader(r.status)
+	w.Write(r.body)
+}
+
+// SetFailureSeed seeds the source used to decide which calls fail, so that
+// failures can be reproduced.
+func (srv *Server) SetFailureSeed(seed int64) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.rand = rand.New(rand.NewSource(seed))
+}
+
+// xmlErrors is an error response as AWS writes it.
 type xmlErrors struct {
-	XMLName string `xml:"ErrorResponse"`
-	Error   elb.Error
+	XMLName   xml.Name `xml:"http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/ ErrorResponse"`
+	Error     xmlError `xml:"Error"`
+	RequestId string   `xml:"RequestId"`
+}
+
+type xmlError struct {
+	Type    string `xml:"Type"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// errorType tells whether an error with the given HTTP status was caused by
+// the Sender of the request or by the Receiver.
+func errorType(statusCode int) string {
+	if statusCode >= 500 {
+		return "Receiver"
+	}
+	return "Sender"
 }
 
 func (srv *Server) error(w http.ResponseWriter, err *elb.Error) {
 	w.WriteHeader(err.StatusCode)
-	xmlErr := xmlErrors{Error: *err}
+	xmlErr := xmlErrors{
+		Error: xmlError{
+			Type:    errorType(err.StatusCode),
+			Code:    err.Code,
+			Message: err.Message,
+		},
+		RequestId: err.RequestId,
+	}
 	if e := xml.NewEncoder(w).Encode(xmlErr); e != nil {
-		panic(e)
+		srv.logf("Fake ELB server failed to encode error %v: %v", err, e)
+	}
+}
+
+// internalError wraps an unexpected error so it is reported to the client as
+// a 500 rather than crashing the server.
+func internalError(err error, reqId string) *elb.Error {
+	return &elb.Error{
+		StatusCode: 500,
+		Code:       "InternalFailure",
+		Message:    err.Error(),
+		RequestId:  reqId,
+	}
+}
+
+// requestId formats the nth request id. Ids are zero padded so that later
+// ids sort after earlier ones.
+func requestId(n int) string {
+	return fmt.Sprintf("req%08X", n)
+}
+
+// RequestIdHeader is the HTTP header in which the server echoes the id of
+// every request it answers, as AWS does.
+const RequestIdHeader = "X-Amzn-RequestId"
+
+// LastRequestId returns the id of the last request the server received, or
+// "" if it hasn't received any.
+func (srv *Server) LastRequestId() string {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.reqId == 0 {
+		return ""
 	}
+	return requestId(srv.reqId - 1)
 }
 
 func (srv *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
-	req.ParseForm()
+	if req.Method == "GET" && req.URL.Path == "/ping" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 	srv.mutex.Lock()
 	defer srv.mutex.Unlock()
-	f := actions[req.Form.Get("Action")]
+	reqId := requestId(srv.reqId)
+	srv.reqId++
+	w.Header().Set(RequestIdHeader, reqId)
+	if err := parseForm(req); err != nil {
+		err.RequestId = reqId
+		srv.error(w, err)
+		srv.logf("Fake ELB server can't parse request: %s", err.Message)
+		return
+	}
+	if srv.onRequest != nil {
+		srv.onRequest(req)
+	}
+	if srv.authError != nil {
+		err := *srv.authError
+		err.RequestId = reqId
+		srv.error(w, &err)
+		return
+	}
+	action := req.Form.Get("Action")
+	f := actions[action]
 	if f == nil {
 		srv.error(w, &elb.Error{
 			StatusCode: 400,
 			Code:       "InvalidParameterValue",
 			Message:    "Unrecognized Action",
+			RequestId:  reqId,
+		})
+		srv.logf("Fake ELB server doesn't know how to: %s", action)
+		return
+	}
+	srv.operations = append(srv.operations, action)
+	form := make(url.Values, len(req.Form))
+	for key, values := range req.Form {
+		form[key] = append([]string(nil), values...)
+	}
+	srv.operationForms = append(srv.operationForms, form)
+	if raw, ok := srv.rawResponses[action]; ok {
+		raw.write(w)
+		return
+	}
+	if rate, ok := srv.failureRates[action]; ok && srv.rand.Float64() < rate {
+		srv.error(w, &elb.Error{
+			StatusCode: 400,
+			Code:       "Throttling",
+			Message:    "Rate exceeded",
+			RequestId:  reqId,
 		})
-		fmt.Printf("Fake ELB server doesn't know how to: %s\n", req.Form.Get("Action"))
 		return
 	}
-	reqId := fmt.Sprintf("req%0X", srv.reqId)
-	srv.reqId++
 	if resp, err := f(srv, w, req, reqId); err == nil {
-		if err := xml.NewEncoder(w).Encode(resp); err != nil {
-			panic(err)
+		var body bytes.Buffer
+		if err := xml.NewEncoder(&body).Encode(resp); err != nil {
+			srv.logf("Fake ELB server failed to encode %s response: %v", action, err)
+			srv.error(w, internalError(err, reqId))
+			return
 		}
+		body.WriteTo(w)
 	} else {
 		switch err.(type) {
 		case *elb.Error:
-			srv.error(w, err.(*elb.Error))
+			e := *err.(*elb.Error)
+			e.RequestId = reqId
+			srv.error(w, &e)
 		default:
-			panic(err)
+			srv.logf("Fake ELB server failed to %s: %v", action, err)
+			srv.error(w, internalError(err, reqId))
+		}
+	}
+}
+
+// parseForm parses the parameters of req, which may be sent in the URL query
+// of any request or in the form-encoded body of a POST.
+func parseForm(req *http.Request) *elb.Error {
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || mediaType != "application/x-www-form-urlencoded" {
+			return &elb.Error{
+				StatusCode: 415,
+				Code:       "UnsupportedMediaType",
+				Message:    fmt.Sprintf("Unsupported content type: %s", ct),
+			}
+		}
+	}
+	if err := req.ParseForm(); err != nil {
+		return &elb.Error{
+			StatusCode: 400,
+			Code:       "MalformedQueryString",
+			Message:    err.Error(),
 		}
 	}
+	return nil
 }
 
 func (srv *Server) createLoadBalancer(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
@@ -120,23 +659,177 @@ func (srv *Server) createLoadBalancer(w http.ResponseWriter, req *http.Request,
 	if err := srv.validate(req, required); err != nil {
 		return nil, err
 	}
+	if err := validateLoadBalancerName(req.FormValue("LoadBalancerName")); err != nil {
+		return nil, err
+	}
+	switch req.FormValue("Scheme") {
+	case "", "internet-facing":
+	case "internal":
+		if req.FormValue("Subnets.member.1") == "" {
+			return nil, &elb.Error{
+				StatusCode: 400,
+				Code:       "ValidationError",
+				Message:    "Internal load balancers must be created in subnets of a VPC.",
+			}
+		}
+	default:
+		return nil, &elb.Error{
+			StatusCode: 400,
+			Code:       "ValidationError",
+			Message:    fmt.Sprintf("Invalid Scheme %s: must be internet-facing or internal", req.FormValue("Scheme")),
+		}
+	}
+	if err := validateListenerPorts(req.Form); err != nil {
+		return nil, err
+	}
+	tags := makeTags(req.Form)
+	keys := map[string]bool{}
+	for _, tag := range tags {
+		if keys[tag.Key] {
+			return nil, &elb.Error{
+				StatusCode: 400,
+				Code:       "DuplicateTagKeys",
+				Message:    fmt.Sprintf("Tag key %s is specified more than once.", tag.Key),
+			}
+		}
+		keys[tag.Key] = true
+	}
 	path := req.FormValue("Path")
 	if path == "" {
 		path = "/"
 	}
 	lbName := req.FormValue("LoadBalancerName")
-	srv.lbs[lbName] = srv.makeLoadBalancer(req.Form)
-	srv.lbs[lbName].DNSName = fmt.Sprintf("%s-some-aws-stuff.us-east-1.elb.amazonaws.com", lbName)
+	lb := srv.makeLoadBalancer(req.Form)
+	if existing, ok := srv.lbs[lbName]; ok {
+		if !srv.idempotent || !sameConfiguration(existing, lb) {
+			return nil, &elb.Error{
+				StatusCode: 400,
+				Code:       "DuplicateLoadBalancerName",
+				Message:    fmt.Sprintf("Load balancer name '%s' is already in use.", lbName),
+			}
+		}
+		return elb.CreateLoadBalancerResp{
+			DNSName:          existing.DNSName,
+			HostedZoneNameID: existing.HostedZoneNameID,
+			RequestId:        reqId,
+		}, nil
+	}
+	if srv.exceedsLimit(LimitLBsPerAccount, len(srv.lbs)+1) {
+		return nil, &elb.Error{
+			StatusCode: 400,
+			Code:       "TooManyLoadBalancers",
+			Message:    fmt.Sprintf("Exceeded quota of account: at most %d load balancers are allowed.", srv.limits[LimitLBsPerAccount]),
+		}
+	}
+	if srv.exceedsLimit(LimitListenersPerLB, len(lb.Listeners)) {
+		return nil, srv.tooManyListeners(lbName)
+	}
+	srv.lbs[lbName] = lb
+	if srv.describeDelay > 0 {
+		srv.unconverged[lbName] = srv.describeDelay
+	}
+	delete(srv.healthChecks, lbName)
+	delete(srv.lbAttrs, lbName)
+	delete(srv.lbTags, lbName)
+	if len(tags) > 0 {
+		srv.lbTags[lbName] = tags
+	}
+	srv.lbs[lbName].DNSName = fmt.Sprintf("%s-some-aws-stuff.%s.%s", lbName, srv.options.Region, srv.options.DNSSuffix)
+	srv.lbs[lbName].HostedZoneNameID = hostedZoneNameID(srv.options.Region)
+	srv.lbs[lbName].HostedZoneName = canonicalHostedZoneName(srv.lbs[lbName])
+	srv.lbs[lbName].CreatedTime = now()
+	srv.lbs[lbName].SourceSecurityGroup = sourceSecurityGroup(lbName)
 	return elb.CreateLoadBalancerResp{
-		DNSName: srv.lbs[lbName].DNSName,
+		DNSName:          srv.lbs[lbName].DNSName,
+		HostedZoneNameID: srv.lbs[lbName].HostedZoneNameID,
+		RequestId:        reqId,
 	}, nil
 }
 
+// sameConfiguration reports whether two load balancers have the same
+// listeners, availability zones, subnets and scheme.
+func sameConfiguration(a, b *elb.LoadBalancer) bool {
+	if len(a.Listeners) != len(b.Listeners) || a.Scheme != b.Scheme {
+		return false
+	}
+	for i, l := range a.Listeners {
+		m := b.Listeners[i]
+		if l.Protocol != m.Protocol || l.LoadBalancerPort != m.LoadBalancerPort ||
+			l.InstanceProtocol != m.InstanceProtocol || l.InstancePort != m.InstancePort ||
+			l.SSLCertificateId != m.SSLCertificateId {
+			return false
+		}
+	}
+	return sameStrings(a.AvailabilityZones, b.AvailabilityZones) && sameStrings(a.Subnets, b.Subnets)
+}
+
+// sameStrings reports whether a and b hold the same strings, in any order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sourceSecurityGroup returns the source security group of the load balancer
+// named lbName.
+func sourceSecurityGroup(lbName string) elb.SourceSecurityGroup {
+	return elb.SourceSecurityGroup{
+		OwnerAlias: "amazon-elb",
+		GroupName:  "amazon-elb-sg-" + lbName,
+	}
+}
+
+// canonicalHostedZoneName returns the name aliases to lb can point at, which
+// is its DNS name. As on AWS, internal load balancers have none.
+func canonicalHostedZoneName(lb *elb.LoadBalancer) string {
+	if lb.Scheme == "internal" {
+		return ""
+	}
+	return lb.DNSName
+}
+
+// now returns the current time with the millisecond precision of AWS
+// timestamps.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// createdTimeFormat is the layout of the CreatedTime of a load balancer, which
+// AWS always gives with three fraction digits.
+const createdTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// hostedZoneNameIDs are the canonical hosted zone name ids AWS uses for load
+// balancers in a region.
+var hostedZoneNameIDs = map[string]string{
+	"us-east-1": "Z35SXDOTRQ7X7K",
+	"sa-east-1": "Z2P70J7HTTTPLU",
+}
+
+// hostedZoneNameID returns the canonical hosted zone name id of load
+// balancers created in region. Unknown regions get a stable id derived from
+// the region name.
+func hostedZoneNameID(region string) string {
+	if id, ok := hostedZoneNameIDs[region]; ok {
+		return id
+	}
+	return fmt.Sprintf("Z%X", crc32.ChecksumIEEE([]byte(region)))
+}
+
 func (srv *Server) deleteLoadBalancer(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
 	if err := srv.validate(req, []string{"LoadBalancerName"}); err != nil {
 		return nil, err
 	}
-	srv.RemoveLoadBalancer(req.FormValue("LoadBalancerName"))
+	srv.removeLoadBalancer(req.FormValue("LoadBalancerName"))
 	return elb.SimpleResp{RequestId: reqId}, nil
 }
 
@@ -149,21 +842,27 @@ func (srv *Server) registerInstancesWithLoadBalancer(w http.ResponseWriter, req
 	if err := srv.lbExists(lbName); err != nil {
 		return nil, err
 	}
-	instIds := []string{}
-	instances := []elb.Instance{}
-	i := 1
-	instId := req.FormValue(fmt.Sprintf("Instances.member.%d.InstanceId", i))
-	for instId != "" {
+	instIds := requestInstanceIds(req)
+	for _, instId := range instIds {
+		if err := validateInstanceId(instId); err != nil {
+			return nil, err
+		}
 		if err := srv.instanceExists(instId); err != nil {
 			return nil, err
 		}
-		instIds = append(instIds, instId)
+	}
+	// Only once every id is valid is the load balancer changed. As on AWS,
+	// registering an instance that is already registered does nothing.
+	lb := srv.lbs[lbName]
+	instances := []elb.Instance{}
+	for _, instId := range instIds {
 		instances = append(instances, elb.Instance{InstanceId: instId})
-		i++
-		instId = req.FormValue(fmt.Sprintf("Instances.member.%d.InstanceId", i))
+		if hasInstance(lb, instId) {
+			continue
+		}
+		lb.Instances = append(lb.Instances, elb.Instance{InstanceId: instId})
+		srv.instanceStates[lbName] = append(srv.instanceStates[lbName], srv.makeInstanceState(instId))
 	}
-	srv.instanceStates[lbName] = append(srv.instanceStates[lbName], srv.makeInstanceState(instId))
-	srv.lbs[lbName].Instances = append(srv.lbs[lbName].Instances, instances...)
 	return elb.RegisterInstancesWithLoadBalancerResp{Instances: instances}, nil
 }
 
@@ -176,101 +875,346 @@ func (srv *Server) deregisterInstancesFromLoadBalancer(w http.ResponseWriter, re
 	if err := srv.lbExists(lbName); err != nil {
 		return nil, err
 	}
-	i := 1
-	lb := srv.lbs[lbName]
-	instId := req.FormValue(fmt.Sprintf("Instances.member.%d.InstanceId", i))
-	for instId != "" {
+	instIds := requestInstanceIds(req)
+	for _, instId := range instIds {
 		if err := srv.instanceExists(instId); err != nil {
 			return nil, err
 		}
-		i++
+	}
+	lb := srv.lbs[lbName]
+	for _, instId := range instIds {
 		removeInstanceFromLB(lb, instId)
-		instId = req.FormValue(fmt.Sprintf("Instances.member.%d.InstanceId", i))
+		srv.removeInstanceStatesFromLoadBalancer(lbName, instId)
 	}
-	srv.lbs[lbName] = lb
-	srv.removeInstanceStatesFromLoadBalancer(lbName, instId)
 	return elb.SimpleResp{RequestId: reqId}, nil
 }
 
+// requestInstanceIds returns the instance ids given by the
+// Instances.member.N.InstanceId parameters of a request.
+func requestInstanceIds(req *http.Request) []string {
+	var ids []string
+	for i := 1; req.FormValue(fmt.Sprintf("Instances.member.%d.InstanceId", i)) != ""; i++ {
+		ids = append(ids, req.FormValue(fmt.Sprintf("Instances.member.%d.InstanceId", i)))
+	}
+	return ids
+}
+
+// hasInstance reports whether the instance with the given id is registered
+// with lb.
+func hasInstance(lb *elb.LoadBalancer, id string) bool {
+	for _, instance := range lb.Instances {
+		if instance.InstanceId == id {
+			return true
+		}
+	}
+	return false
+}
+
 func (srv *Server) describeLoadBalancers(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
-	i := 1
-	lbName := req.FormValue(fmt.Sprintf("LoadBalancerNames.member.%d", i))
-	for lbName != "" {
-		key := fmt.Sprintf("LoadBalancerNames.member.%d", i)
-		if req.FormValue(key) != "" {
-			if err := srv.lbExists(req.FormValue(key)); err != nil {
-				return nil, err
+	hidden := srv.converge()
+	// As on AWS, asking for load balancers by name describes only those.
+	requested := make(map[string]bool)
+	for _, lbName := range srv.getParameters("LoadBalancerNames.member.", req.Form) {
+		if err := srv.lbExists(lbName); err != nil {
+			return nil, err
+		}
+		if hidden[lbName] {
+			return nil, &elb.Error{
+				StatusCode: 400,
+				Code:       "LoadBalancerNotFound",
+				Message:    fmt.Sprintf("There is no ACTIVE Load Balancer named '%s'", lbName),
 			}
 		}
-		i++
-		lbName = req.FormValue(fmt.Sprintf("LoadBalancerNames.member.%d", i))
+		requested[lbName] = true
 	}
-	lbsDesc := make([]elb.LoadBalancer, len(srv.lbs))
-	i = 0
-	for _, lb := range srv.lbs {
-		lbsDesc[i] = *lb
-		i++
+	pageSize := srv.options.PageSize
+	if size := req.FormValue("PageSize"); size != "" {
+		if n, err := strconv.Atoi(size); err == nil && n > 0 {
+			if n > maxPageSize {
+				n = maxPageSize
+			}
+			pageSize = n
+		}
 	}
-	resp := elb.DescribeLoadBalancersResp{
-		LoadBalancers: lbsDesc,
+	names := make([]string, 0, len(srv.lbs))
+	for name := range srv.lbs {
+		if !hidden[name] && (len(requested) == 0 || requested[name]) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	start := sort.SearchStrings(names, req.FormValue("Marker"))
+	names = names[start:]
+	resp := describeLoadBalancersResp{RequestId: reqId}
+	if len(names) > pageSize {
+		resp.NextMarker = names[pageSize]
+		names = names[:pageSize]
+	}
+	for _, name := range names {
+		resp.LoadBalancers.Members = append(resp.LoadBalancers.Members, makeXMLLoadBalancer(srv.lbs[name], srv.lbPolicies[name]))
 	}
 	return resp, nil
 }
 
+// maxPageSize is the default and largest number of load balancers returned by
+// a single DescribeLoadBalancers call.
+const maxPageSize = 400
+
+// The types below mirror those of the elb package, but always encode list
+// containers, even when empty, as AWS does.
+
+type describeLoadBalancersResp struct {
+	XMLName       xml.Name         `xml:"DescribeLoadBalancersResponse"`
+	LoadBalancers xmlLoadBalancers `xml:"DescribeLoadBalancersResult>LoadBalancerDescriptions"`
+	NextMarker    string           `xml:"DescribeLoadBalancersResult>NextMarker,omitempty"`
+	RequestId     string           `xml:"ResponseMetadata>RequestId"`
+}
+
+type xmlLoadBalancers struct {
+	Members []xmlLoadBalancer `xml:"member"`
+}
+
+type xmlLoadBalancer struct {
+	LoadBalancerName          string                  `xml:"LoadBalancerName"`
+	Listeners                 xmlListeners            `xml:"ListenerDescriptions"`
+	Instances                 xmlInstances            `xml:"Instances"`
+	HealthCheck               elb.HealthCheck         `xml:"HealthCheck"`
+	AvailabilityZones         xmlStrings              `xml:"AvailabilityZones"`
+	HostedZoneNameID          string                  `xml:"CanonicalHostedZoneNameID"`
+	HostedZoneName            string                  `xml:"CanonicalHostedZoneName,omitempty"`
+	DNSName                   string                  `xml:"DNSName"`
+	SecurityGroups            xmlStrings              `xml:"SecurityGroups"`
+	Scheme                    string                  `xml:"Scheme"`
+	Subnets                   xmlStrings              `xml:"Subnets"`
+	VPCId                     string                  `xml:"VPCId"`
+	SourceSecurityGroup       elb.SourceSecurityGroup `xml:"SourceSecurityGroup"`
+	Policies                  xmlPolicies             `xml:"Policies"`
+	BackendServerDescriptions xmlBackendServers       `xml:"BackendServerDescriptions"`
+	CreatedTime               string                  `xml:"CreatedTime"`
+}
+
+type xmlPolicies struct {
+	AppCookieStickinessPolicies xmlAppCookiePolicies `xml:"AppCookieStickinessPolicies"`
+	LBCookieStickinessPolicies  xmlLBCookiePolicies  `xml:"LBCookieStickinessPolicies"`
+	OtherPolicies               xmlStrings           `xml:"OtherPolicies"`
+}
+
+type xmlAppCookiePolicies struct {
+	Members []elb.AppCookieStickinessPolicy `xml:"member"`
+}
+
+type xmlLBCookiePolicies struct {
+	Members []elb.LBCookieStickinessPolicy `xml:"member"`
+}
+
+type xmlListeners struct {
+	Members []xmlListener `xml:"member"`
+}
+
+type xmlListener struct {
+	InstancePort     int64      `xml:"Listener>InstancePort"`
+	InstanceProtocol string     `xml:"Listener>InstanceProtocol"`
+	SSLCertificateId string     `xml:"Listener>SSLCertificateId"`
+	LoadBalancerPort int64      `xml:"Listener>LoadBalancerPort"`
+	Protocol         string     `xml:"Listener>Protocol"`
+	PolicyNames      xmlStrings `xml:"PolicyNames"`
+}
+
+type xmlInstances struct {
+	Members []elb.Instance `xml:"member"`
+}
+
+type xmlBackendServers struct {
+	Members []xmlBackendServer `xml:"member"`
+}
+
+type xmlBackendServer struct {
+	InstancePort int64      `xml:"InstancePort"`
+	PolicyNames  xmlStrings `xml:"PolicyNames"`
+}
+
+type xmlStrings struct {
+	Members []string `xml:"member"`
+}
+
+func makeXMLLoadBalancer(lb *elb.LoadBalancer, policies []elb.Policy) xmlLoadBalancer {
+	x := xmlLoadBalancer{
+		LoadBalancerName:    lb.LoadBalancerName,
+		Instances:           xmlInstances{lb.Instances},
+		HealthCheck:         lb.HealthCheck,
+		AvailabilityZones:   xmlStrings{lb.AvailabilityZones},
+		HostedZoneNameID:    lb.HostedZoneNameID,
+		HostedZoneName:      lb.HostedZoneName,
+		DNSName:             lb.DNSName,
+		SecurityGroups:      xmlStrings{lb.SecurityGroups},
+		Scheme:              lb.Scheme,
+		Subnets:             xmlStrings{lb.Subnets},
+		VPCId:               lb.VPCId,
+		SourceSecurityGroup: lb.SourceSecurityGroup,
+		CreatedTime:         lb.CreatedTime.UTC().Format(createdTimeFormat),
+	}
+	for _, l := range lb.Listeners {
+		x.Listeners.Members = append(x.Listeners.Members, xmlListener{
+			InstancePort:     l.InstancePort,
+			InstanceProtocol: l.InstanceProtocol,
+			SSLCertificateId: l.SSLCertificateId,
+			LoadBalancerPort: l.LoadBalancerPort,
+			Protocol:         l.Protocol,
+			PolicyNames:      xmlStrings{l.PolicyNames},
+		})
+	}
+	for _, b := range lb.BackendServerDescriptions {
+		x.BackendServerDescriptions.Members = append(x.BackendServerDescriptions.Members, xmlBackendServer{
+			InstancePort: b.InstancePort,
+			PolicyNames:  xmlStrings{b.PolicyNames},
+		})
+	}
+	for _, p := range policies {
+		switch p.PolicyTypeName {
+		case "AppCookieStickinessPolicyType":
+			x.Policies.AppCookieStickinessPolicies.Members = append(x.Policies.AppCookieStickinessPolicies.Members, elb.AppCookieStickinessPolicy{
+				PolicyName: p.PolicyName,
+				CookieName: policyAttribute(p, "CookieName"),
+			})
+		case "LBCookieStickinessPolicyType":
+			period, _ := strconv.ParseInt(policyAttribute(p, "CookieExpirationPeriod"), 10, 64)
+			x.Policies.LBCookieStickinessPolicies.Members = append(x.Policies.LBCookieStickinessPolicies.Members, elb.LBCookieStickinessPolicy{
+				PolicyName:             p.PolicyName,
+				CookieExpirationPeriod: period,
+			})
+		default:
+			x.Policies.OtherPolicies.Members = append(x.Policies.OtherPolicies.Members, p.PolicyName)
+		}
+	}
+	return x
+}
+
+// policyAttribute returns the value of the named attribute of a policy, or ""
+// if the policy doesn't set it.
+func policyAttribute(policy elb.Policy, name string) string {
+	for _, attr := range policy.PolicyAttributes {
+		if attr.AttributeName == name {
+			return attr.AttributeValue
+		}
+	}
+	return ""
+}
+
 func (srv *Server) addTags(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
 	lbName := req.FormValue("LoadBalancerNames.member.1")
 
+	tags := makeTags(req.Form)
+
+	if len(srv.lbTags) == 0 {
+		srv.lbTags[lbName] = tags
+	} else {
+		srv.lbTags[lbName] = append(srv.lbTags[lbName], tags...)
+	}
+	return elb.AddTagsResp{RequestId: reqId}, nil
+}
+
+// makeTags returns the tags of a request, given as Tags.member.N.Key and
+// Tags.member.N.Value.
+func makeTags(values url.Values) []elb.Tag {
 	tags := []elb.Tag{}
 
 	i := 1
-	tagKey := req.FormValue(fmt.Sprintf("Tags.member.%d.Key", i))
+	tagKey := values.Get(fmt.Sprintf("Tags.member.%d.Key", i))
 	for tagKey != "" {
-		tagValue := req.FormValue(fmt.Sprintf("Tags.member.%d.Value", i))
+		tagValue := values.Get(fmt.Sprintf("Tags.member.%d.Value", i))
 		tags = append(tags, elb.Tag{Key: tagKey, Value: tagValue})
 
 		i++
-		tagKey = req.FormValue(fmt.Sprintf("Tags.member.%d.Key", i))
+		tagKey = values.Get(fmt.Sprintf("Tags.member.%d.Key", i))
 	}
+	return tags
+}
 
-	if len(srv.lbTags) == 0 {
-		srv.lbTags[lbName] = tags
-	} else {
-		srv.lbTags[lbName] = append(srv.lbTags[lbName], tags...)
+func (srv *Server) removeTags(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
+	keys := []string{}
+	for i := 1; req.FormValue(fmt.Sprintf("Tags.member.%d.Key", i)) != ""; i++ {
+		keys = append(keys, req.FormValue(fmt.Sprintf("Tags.member.%d.Key", i)))
+	}
+	for _, lbName := range srv.getParameters("LoadBalancerNames.member.", req.Form) {
+		tags := []elb.Tag{}
+		for _, tag := range srv.lbTags[lbName] {
+			if !containsString(keys, tag.Key) {
+				tags = append(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			delete(srv.lbTags, lbName)
+		} else {
+			srv.lbTags[lbName] = tags
+		}
 	}
-	return elb.AddTagsResp{RequestId: "fake-req-id"}, nil
+	return elb.RemoveTagsResp{RequestId: reqId}, nil
 }
 
 func (srv *Server) describeTags(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
 	lbName := req.FormValue("LoadBalancerNames.member.1")
 
-	lbTag := elb.LoadBalancerTag{
-		Tags:             srv.lbTags[lbName],
+	// The Tags element is present even when the load balancer has no tags.
+	lbTag := xmlTagDescription{
+		Tags:             xmlTags{srv.lbTags[lbName]},
 		LoadBalancerName: lbName,
 	}
 
-	return elb.DescribeTagsResp{
-		RequestId:        "fake-req-id",
-		NextToken:        "who knows!",
-		LoadBalancerTags: []elb.LoadBalancerTag{lbTag},
+	// DescribeTags is not paginated, so NextToken is always empty.
+	return describeTagsResp{
+		RequestId:        reqId,
+		LoadBalancerTags: []xmlTagDescription{lbTag},
 	}, nil
 }
 
+// describeTagsResp mirrors elb.DescribeTagsResp, writing an empty Tags
+// element for load balancers without tags.
+type describeTagsResp struct {
+	XMLName          xml.Name            `xml:"DescribeTagsResponse"`
+	LoadBalancerTags []xmlTagDescription `xml:"DescribeTagsResult>TagDescriptions>member"`
+	NextToken        string              `xml:"DescribeTagsResult>NextToken"`
+	RequestId        string              `xml:"ResponseMetadata>RequestId"`
+}
+
+type xmlTagDescription struct {
+	Tags             xmlTags `xml:"Tags"`
+	LoadBalancerName string  `xml:"LoadBalancerName"`
+}
+
+type xmlTags struct {
+	Members []elb.Tag `xml:"member"`
+}
+
 func (srv *Server) createLoadBalancerListeners(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
 	resp := &elb.SimpleResp{}
 	lbName := req.FormValue("LoadBalancerName")
+	lb, ok := srv.lbs[lbName]
+	if !ok {
+		return nil, &elb.Error{
+			StatusCode: 400,
+			Code:       "AccessPointNotFound",
+			Message:    "The specified load balancer does not exist.",
+		}
+	}
+	if err := validateListenerPorts(req.Form); err != nil {
+		return nil, err
+	}
 	listeners := srv.makeLoadBalancer(req.Form).Listeners
 	for _, listener := range listeners {
-		for _, existingListener := range srv.lbs[lbName].Listeners {
+		for _, existingListener := range lb.Listeners {
 			if listener.LoadBalancerPort == existingListener.LoadBalancerPort {
 				return nil, &elb.Error{
 					StatusCode: 400,
-					Code:       "400",
-					Message:    "Bad Request",
+					Code:       "DuplicateListener",
+					Message:    fmt.Sprintf("A listener already exists for %s with LoadBalancerPort %d.", lbName, listener.LoadBalancerPort),
 				}
 			}
 		}
 	}
-	srv.lbs[lbName].Listeners = listeners
+	if srv.exceedsLimit(LimitListenersPerLB, len(lb.Listeners)+len(listeners)) {
+		return nil, srv.tooManyListeners(lbName)
+	}
+	lb.Listeners = append(lb.Listeners, listeners...)
 
 	return resp, nil
 }
@@ -294,7 +1238,11 @@ func (srv *Server) deleteLoadBalancerListeners(w http.ResponseWriter, req *http.
 	for port != "" {
 		portNumber, err := strconv.ParseInt(port, 10, 64)
 		if err != nil {
-			panic(err)
+			return nil, &elb.Error{
+				StatusCode: 400,
+				Code:       "ValidationError",
+				Message:    fmt.Sprintf("Invalid LoadBalancerPort: %s", port),
+			}
 		}
 
 		lbPorts = append(lbPorts, portNumber)
@@ -316,6 +1264,13 @@ func (srv *Server) deleteLoadBalancerListeners(w http.ResponseWriter, req *http.
 			listenersToKeep = append(listenersToKeep, listener)
 		}
 	}
+	if srv.strict && len(listenersToKeep) == 0 && len(lb.Listeners) > 0 {
+		return nil, &elb.Error{
+			StatusCode: 400,
+			Code:       "ValidationError",
+			Message:    "A load balancer must have at least one listener.",
+		}
+	}
 
 	lb.Listeners = listenersToKeep
 
@@ -336,8 +1291,25 @@ func (srv *Server) setLoadBalancerListenerSSLCertificate(w http.ResponseWriter,
 		}
 	}
 
+	if lbSSLCertificateId == "" {
+		return nil, &elb.Error{
+			StatusCode: 400,
+			Code:       "ValidationError",
+			Message:    "SSLCertificateId is required.",
+		}
+	}
+
 	for i, listener := range lb.Listeners {
 		if fmt.Sprintf("%d", listener.LoadBalancerPort) == lbPort {
+			switch strings.ToUpper(listener.Protocol) {
+			case "HTTPS", "SSL":
+			default:
+				return nil, &elb.Error{
+					StatusCode: 400,
+					Code:       "ValidationError",
+					Message:    fmt.Sprintf("Listener on port %s uses %s, which does not support certificates.", lbPort, listener.Protocol),
+				}
+			}
 			lb.Listeners[i].SSLCertificateId = lbSSLCertificateId
 			return resp, nil
 		}
@@ -350,6 +1322,271 @@ func (srv *Server) setLoadBalancerListenerSSLCertificate(w http.ResponseWriter,
 	}
 }
 
+// policyTypes are the policy types known to the server, from which policies
+// can be created.
+var policyTypes = []elb.PolicyType{
+	{
+		PolicyTypeName: "AppCookieStickinessPolicyType",
+		Description:    "Stickiness policy with session lifetimes controlled by the lifetime of the application-generated cookie.",
+		PolicyAttributeTypes: []elb.PolicyAttributeType{
+			{AttributeName: "CookieName", AttributeType: "String", Cardinality: "ONE"},
+		},
+	},
+	{
+		PolicyTypeName: "BackendServerAuthenticationPolicyType",
+		Description:    "Policy that controls authentication to back-end server(s) and contains one or more policies, such as an instance of a PublicKeyPolicyType.",
+		PolicyAttributeTypes: []elb.PolicyAttributeType{
+			{AttributeName: "PublicKeyPolicyName", AttributeType: "PolicyName", Cardinality: "ONE_OR_MORE"},
+		},
+	},
+	{
+		PolicyTypeName: "LBCookieStickinessPolicyType",
+		Description:    "Stickiness policy with session lifetimes controlled by the browser (user-agent) or a specified expiration period.",
+		PolicyAttributeTypes: []elb.PolicyAttributeType{
+			{AttributeName: "CookieExpirationPeriod", AttributeType: "Long", Cardinality: "ZERO_OR_ONE"},
+		},
+	},
+	{
+		PolicyTypeName: "ProxyProtocolPolicyType",
+		Description:    "Policy that controls whether to include the IP address and port of the originating request for TCP messages.",
+		PolicyAttributeTypes: []elb.PolicyAttributeType{
+			{AttributeName: "ProxyProtocol", AttributeType: "Boolean", Cardinality: "ONE"},
+		},
+	},
+	{
+		PolicyTypeName: "PublicKeyPolicyType",
+		Description:    "Policy containing a list of public keys to accept when authenticating the back-end server(s).",
+		PolicyAttributeTypes: []elb.PolicyAttributeType{
+			{AttributeName: "PublicKey", AttributeType: "String", Cardinality: "ONE"},
+		},
+	},
+	{
+		PolicyTypeName: "SSLNegotiationPolicyType",
+		Description:    "Listener policy that defines the ciphers and protocols that will be accepted by the load balancer.",
+		PolicyAttributeTypes: []elb.PolicyAttributeType{
+			{AttributeName: "Reference-Security-Policy", AttributeType: "String", Cardinality: "ZERO_OR_ONE"},
+			{AttributeName: "Protocol-TLSv1", AttributeType: "Boolean", Cardinality: "ZERO_OR_ONE", DefaultValue: "true"},
+			{AttributeName: "Protocol-TLSv1.1", AttributeType: "Boolean", Cardinality: "ZERO_OR_ONE", DefaultValue: "true"},
+			{AttributeName: "Protocol-TLSv1.2", AttributeType: "Boolean", Cardinality: "ZERO_OR_ONE", DefaultValue: "true"},
+		},
+	},
+}
+
+func (srv *Server) describeLoadBalancerPolicyTypes(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
+	names := srv.getParameters("PolicyTypeNames.member.", req.Form)
+	if len(names) == 0 {
+		return elb.DescribeLoadBalancerPolicyTypesResp{PolicyTypes: policyTypes, RequestId: reqId}, nil
+	}
+	types := []elb.PolicyType{}
+	for _, name := range names {
+		policyType, err := srv.policyType(name)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, policyType)
+	}
+	return elb.DescribeLoadBalancerPolicyTypesResp{PolicyTypes: types, RequestId: reqId}, nil
+}
+
+func (srv *Server) createLoadBalancerPolicy(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
+	required := []string{"LoadBalancerName", "PolicyName", "PolicyTypeName"}
+	if err := srv.validate(req, required); err != nil {
+		return nil, err
+	}
+	lbName := req.FormValue("LoadBalancerName")
+	if err := srv.lbExists(lbName); err != nil {
+		return nil, err
+	}
+	policyName := req.FormValue("PolicyName")
+	if _, err := srv.policy(lbName, policyName); err == nil {
+		return nil, &elb.Error{
+			StatusCode: 400,
+			Code:       "DuplicatePolicyName",
+			Message:    fmt.Sprintf("Policy '%s' already exists for load balancer '%s'", policyName, lbName),
+		}
+	}
+	if _, err := srv.policyType(req.FormValue("PolicyTypeName")); err != nil {
+		return nil, err
+	}
+	attributes := []elb.PolicyAttribute{}
+	i := 1
+	attrName := req.FormValue(fmt.Sprintf("PolicyAttributes.member.%d.AttributeName", i))
+	for attrName != "" {
+		attributes = append(attributes, elb.PolicyAttribute{
+			AttributeName:  attrName,
+			AttributeValue: req.FormValue(fmt.Sprintf("PolicyAttributes.member.%d.AttributeValue", i)),
+		})
+		i++
+		attrName = req.FormValue(fmt.Sprintf("PolicyAttributes.member.%d.AttributeName", i))
+	}
+	srv.lbPolicies[lbName] = append(srv.lbPolicies[lbName], elb.Policy{
+		PolicyName:       policyName,
+		PolicyTypeName:   req.FormValue("PolicyTypeName"),
+		PolicyAttributes: attributes,
+	})
+	return elb.SimpleResp{RequestId: reqId}, nil
+}
+
+func (srv *Server) deleteLoadBalancerPolicy(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
+	required := []string{"LoadBalancerName", "PolicyName"}
+	if err := srv.validate(req, required); err != nil {
+		return nil, err
+	}
+	lbName := req.FormValue("LoadBalancerName")
+	if err := srv.lbExists(lbName); err != nil {
+		return nil, err
+	}
+	policyName := req.FormValue("PolicyName")
+	if _, err := srv.policy(lbName, policyName); err != nil {
+		return nil, err
+	}
+	for _, listener := range srv.lbs[lbName].Listeners {
+		for _, name := range listener.PolicyNames {
+			if name == policyName {
+				return nil, &elb.Error{
+					StatusCode: 400,
+					Code:       "InvalidConfigurationRequest",
+					Message:    fmt.Sprintf("Policy '%s' is in use by the listener on port %d", policyName, listener.LoadBalancerPort),
+				}
+			}
+		}
+	}
+	for _, backend := range srv.lbs[lbName].BackendServerDescriptions {
+		for _, name := range backend.PolicyNames {
+			if name == policyName {
+				return nil, &elb.Error{
+					StatusCode: 400,
+					Code:       "InvalidConfigurationRequest",
+					Message:    fmt.Sprintf("Policy '%s' is in use by the backend server on port %d", policyName, backend.InstancePort),
+				}
+			}
+		}
+	}
+	policies := srv.lbPolicies[lbName]
+	for i, policy := range policies {
+		if policy.PolicyName == policyName {
+			srv.lbPolicies[lbName] = append(policies[:i], policies[i+1:]...)
+			break
+		}
+	}
+	return elb.SimpleResp{RequestId: reqId}, nil
+}
+
+func (srv *Server) describeLoadBalancerPolicies(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
+	if err := srv.validate(req, []string{"LoadBalancerName"}); err != nil {
+		return nil, err
+	}
+	lbName := req.FormValue("LoadBalancerName")
+	if err := srv.lbExists(lbName); err != nil {
+		return nil, err
+	}
+	names := srv.getParameters("PolicyNames.member.", req.Form)
+	if len(names) == 0 {
+		return elb.DescribeLoadBalancerPoliciesResp{Policies: srv.lbPolicies[lbName], RequestId: reqId}, nil
+	}
+	policies := []elb.Policy{}
+	for _, name := range names {
+		policy, err := srv.policy(lbName, name)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return elb.DescribeLoadBalancerPoliciesResp{Policies: policies, RequestId: reqId}, nil
+}
+
+func (srv *Server) setLoadBalancerPoliciesOfListener(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
+	required := []string{"LoadBalancerName", "LoadBalancerPort"}
+	if err := srv.validate(req, required); err != nil {
+		return nil, err
+	}
+	lbName := req.FormValue("LoadBalancerName")
+	if err := srv.lbExists(lbName); err != nil {
+		return nil, err
+	}
+	names := srv.getParameters("PolicyNames.member.", req.Form)
+	for _, name := range names {
+		if _, err := srv.policy(lbName, name); err != nil {
+			return nil, err
+		}
+	}
+	lb := srv.lbs[lbName]
+	for i, listener := range lb.Listeners {
+		if fmt.Sprintf("%d", listener.LoadBalancerPort) == req.FormValue("LoadBalancerPort") {
+			lb.Listeners[i].PolicyNames = names
+			return elb.SimpleResp{RequestId: reqId}, nil
+		}
+	}
+	return nil, &elb.Error{
+		StatusCode: 400,
+		Code:       "ListenerNotFound",
+		Message:    "The load balancer does not have a listener configured at the specified port.",
+	}
+}
+
+func (srv *Server) setLoadBalancerPoliciesForBackendServer(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
+	required := []string{"LoadBalancerName", "InstancePort"}
+	if err := srv.validate(req, required); err != nil {
+		return nil, err
+	}
+	lbName := req.FormValue("LoadBalancerName")
+	if err := srv.lbExists(lbName); err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseInt(req.FormValue("InstancePort"), 10, 64)
+	if err != nil {
+		return nil, &elb.Error{
+			StatusCode: 400,
+			Code:       "ValidationError",
+			Message:    fmt.Sprintf("Invalid InstancePort: %s", req.FormValue("InstancePort")),
+		}
+	}
+	names := srv.getParameters("PolicyNames.member.", req.Form)
+	for _, name := range names {
+		if _, err := srv.policy(lbName, name); err != nil {
+			return nil, err
+		}
+	}
+	lb := srv.lbs[lbName]
+	backends := []elb.BackendServerDescription{}
+	for _, backend := range lb.BackendServerDescriptions {
+		if backend.InstancePort != port {
+			backends = append(backends, backend)
+		}
+	}
+	if len(names) > 0 {
+		backends = append(backends, elb.BackendServerDescription{InstancePort: port, PolicyNames: names})
+	}
+	lb.BackendServerDescriptions = backends
+	return elb.SimpleResp{RequestId: reqId}, nil
+}
+
+func (srv *Server) policyType(name string) (elb.PolicyType, error) {
+	for _, policyType := range policyTypes {
+		if policyType.PolicyTypeName == name {
+			return policyType, nil
+		}
+	}
+	return elb.PolicyType{}, &elb.Error{
+		StatusCode: 400,
+		Code:       "PolicyTypeNotFound",
+		Message:    fmt.Sprintf("There is no policy type named '%s'", name),
+	}
+}
+
+func (srv *Server) policy(lbName, name string) (elb.Policy, error) {
+	for _, policy := range srv.lbPolicies[lbName] {
+		if policy.PolicyName == name {
+			return policy, nil
+		}
+	}
+	return elb.Policy{}, &elb.Error{
+		StatusCode: 400,
+		Code:       "PolicyNotFound",
+		Message:    fmt.Sprintf("There is no policy named '%s' for load balancer '%s'", name, lbName),
+	}
+}
+
 // getParameters returns the value all parameters from a request that matches a
 // prefix.
 //
@@ -357,23 +1594,27 @@ func (srv *Server) setLoadBalancerListenerSSLCertificate(w http.ResponseWriter,
 // containing the value of keys "Subnets.member.1", "Subnets.member.2" ...
 // "Subnets.member.N". The prefix must include the trailing dot.
 func (srv *Server) getParameters(prefix string, values url.Values) []string {
-	i, key := 1, ""
-	var k = func(n int) string {
-		return fmt.Sprintf(prefix+"%d", n)
-	}
 	var result []string
-	for i, key = 2, k(i); values.Get(key) != ""; i, key = i+1, k(i) {
-		result = append(result, values.Get(key))
+	for i := 1; values.Get(prefix+strconv.Itoa(i)) != ""; i++ {
+		result = append(result, values.Get(prefix+strconv.Itoa(i)))
 	}
 	return result
 }
 
+// makeInstanceState returns the state given to an instance that has just
+// been registered: a copy of the default set with SetDefaultInstanceState, or
+// the state AWS gives it.
 func (srv *Server) makeInstanceState(id string) *elb.InstanceState {
+	if srv.defaultState != nil {
+		state := *srv.defaultState
+		state.InstanceId = id
+		return &state
+	}
 	return &elb.InstanceState{
-		Description: "Instance is in pending state.",
+		Description: "Instance registration is still in progress.",
 		InstanceId:  id,
-		State:       "OutOfService",
-		ReasonCode:  "Instance",
+		State:       elb.StateOutOfService,
+		ReasonCode:  elb.ReasonCodeELB,
 	}
 }
 
@@ -402,6 +1643,25 @@ func (srv *Server) removeInstanceStatesFromLoadBalancer(lb, id string) {
 	}
 }
 
+// validateListenerPorts checks the ports of the listeners in value are
+// numbers between 1 and 65535.
+func validateListenerPorts(value url.Values) error {
+	for i := 1; value.Get(fmt.Sprintf("Listeners.member.%d.Protocol", i)) != ""; i++ {
+		for _, name := range []string{"InstancePort", "LoadBalancerPort"} {
+			key := fmt.Sprintf("Listeners.member.%d.%s", i, name)
+			port, err := strconv.Atoi(value.Get(key))
+			if err != nil || port < 1 || port > 65535 {
+				return &elb.Error{
+					StatusCode: 400,
+					Code:       "ValidationError",
+					Message:    fmt.Sprintf("Invalid %s: %s, must be between 1 and 65535", key, value.Get(key)),
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func (srv *Server) makeLoadBalancer(value url.Values) *elb.LoadBalancer {
 	lds := []elb.Listener{}
 	i := 1
@@ -433,9 +1693,21 @@ func (srv *Server) makeLoadBalancer(value url.Values) *elb.LoadBalancer {
 	if lbDesc.Scheme == "" {
 		lbDesc.Scheme = "internet-facing"
 	}
+	if len(lbDesc.Subnets) > 0 {
+		lbDesc.VPCId = value.Get("VPCId")
+		if lbDesc.VPCId == "" {
+			lbDesc.VPCId = subnetVPCId(lbDesc.Subnets[0])
+		}
+	}
 	return &lbDesc
 }
 
+// subnetVPCId returns the id of the fake VPC holding a subnet, which is
+// derived from the id of the subnet: subnet-1234 is in vpc-1234.
+func subnetVPCId(subnet string) string {
+	return "vpc-" + strings.TrimPrefix(subnet, "subnet-")
+}
+
 func (srv *Server) makeHealthCheck(value url.Values) elb.HealthCheck {
 	ht := 10
 	timeout := 5
@@ -470,31 +1742,87 @@ func (srv *Server) describeInstanceHealth(w http.ResponseWriter, req *http.Reque
 	if err := srv.lbExists(req.FormValue("LoadBalancerName")); err != nil {
 		return nil, err
 	}
+	lbName := req.FormValue("LoadBalancerName")
 	resp := elb.DescribeInstanceHealthResp{
 		InstanceStates: []elb.InstanceState{},
 	}
-	for _, state := range srv.instanceStates[req.FormValue("LoadBalancerName")] {
-		resp.InstanceStates = append(resp.InstanceStates, *state)
+	// Without requested instances, every registered instance is described.
+	if req.FormValue("Instances.member.1.InstanceId") == "" {
+		for _, state := range srv.instanceStates[lbName] {
+			srv.nextScriptedState(lbName, state.InstanceId)
+		}
+		for _, state := range srv.instanceStates[lbName] {
+			resp.InstanceStates = append(resp.InstanceStates, *state)
+		}
+		return resp, nil
 	}
 	i := 1
 	instanceId := req.FormValue("Instances.member.1.InstanceId")
 	for instanceId != "" {
-		if err := srv.instanceExists(instanceId); err != nil {
+		if err := validateInstanceId(instanceId); err != nil {
 			return nil, err
 		}
-		is := elb.InstanceState{
-			Description: "Instance is in pending state.",
-			InstanceId:  instanceId,
-			State:       "OutOfService",
-			ReasonCode:  "Instance",
+		srv.nextScriptedState(lbName, instanceId)
+		state := srv.instanceState(lbName, instanceId)
+		// Instances that don't exist at all are told apart from those that
+		// exist but aren't registered with this load balancer.
+		if state == nil {
+			if err := srv.instanceExists(instanceId); err != nil {
+				return nil, err
+			}
+			return nil, &elb.Error{
+				StatusCode: 400,
+				Code:       "InvalidInstance",
+				Message:    fmt.Sprintf("Could not find EC2 instance %s registered with load balancer %s", instanceId, lbName),
+			}
 		}
-		resp.InstanceStates = append(resp.InstanceStates, is)
+		resp.InstanceStates = append(resp.InstanceStates, *state)
 		i++
 		instanceId = req.FormValue(fmt.Sprintf("Instances.member.%d.InstanceId", i))
 	}
 	return resp, nil
 }
 
+// nextScriptedState moves an instance registered with a load balancer to the
+// next of the states scripted for it by ScriptInstanceStates, if any. The
+// last state of a script is kept once the script is done.
+func (srv *Server) nextScriptedState(lbName, instId string) {
+	script := srv.stateScripts[lbName][instId]
+	if len(script) == 0 {
+		return
+	}
+	state := script[0]
+	state.InstanceId = instId
+	if len(script) > 1 {
+		srv.stateScripts[lbName][instId] = script[1:]
+	} else {
+		delete(srv.stateScripts[lbName], instId)
+	}
+	for i, s := range srv.instanceStates[lbName] {
+		if s.InstanceId == instId {
+			srv.instanceStates[lbName][i] = &state
+		}
+	}
+}
+
+// instanceState returns the state of an instance registered with a load
+// balancer, or nil if it isn't registered.
+func (srv *Server) instanceState(lbName, instId string) *elb.InstanceState {
+	for _, state := range srv.instanceStates[lbName] {
+		if state.InstanceId == instId {
+			return state
+		}
+	}
+	return nil
+}
+
+// Health check targets are either TCP:port, SSL:port or HTTP(S):port/path,
+// with the protocol in any case.
+var (
+	tcpTarget  = regexp.MustCompile(`^(?i:TCP|SSL):\d+$`)
+	httpTarget = regexp.MustCompile(`^(?i:HTTPS?):\d+/\S*$`)
+)
+
 func (srv *Server) configureHealthCheck(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
 	required := []string{
 		"LoadBalancerName",
@@ -507,25 +1835,18 @@ func (srv *Server) configureHealthCheck(w http.ResponseWriter, req *http.Request
 	if err := srv.validate(req, required); err != nil {
 		return nil, err
 	}
+	lbName := req.FormValue("LoadBalancerName")
+	if err := srv.lbExists(lbName); err != nil {
+		return nil, err
+	}
 
 	target := req.FormValue("HealthCheck.Target")
 
-	tcpReg, err := regexp.Compile(`TCP:[\d]+`)
-	if err != nil {
-		panic(err)
-	}
-
-	if match := tcpReg.FindStringSubmatch(target); match == nil {
-		r, err := regexp.Compile(`[\w]+:[\d]+\/+`)
-		if err != nil {
-			panic(err)
-		}
-		if m := r.FindStringSubmatch(target); m == nil {
-			return nil, &elb.Error{
-				StatusCode: 400,
-				Code:       "ValidationError",
-				Message:    "HealthCheck HTTP Target must specify a port followed by a path that begins with a slash. e.g. HTTP:80/ping/this/path",
-			}
+	if !tcpTarget.MatchString(target) && !httpTarget.MatchString(target) {
+		return nil, &elb.Error{
+			StatusCode: 400,
+			Code:       "ValidationError",
+			Message:    "HealthCheck HTTP Target must specify a port followed by a path that begins with a slash. e.g. HTTP:80/ping/this/path",
 		}
 	}
 	ht, _ := strconv.Atoi(req.FormValue("HealthCheck.HealthyThreshold"))
@@ -541,11 +1862,208 @@ func (srv *Server) configureHealthCheck(w http.ResponseWriter, req *http.Request
 		UnhealthyThreshold: int64(ut),
 	}
 
-	srv.lbs[req.FormValue("LoadBalancerName")].HealthCheck = healthCheck
+	srv.lbs[lbName].HealthCheck = healthCheck
+	srv.healthChecks[lbName] = true
 
 	return elb.ConfigureHealthCheckResp{Check: healthCheck}, nil
 }
 
+func (srv *Server) enableAvailabilityZonesForLoadBalancer(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
+	lb, zones, err := srv.availabilityZonesRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, zone := range zones {
+		if !containsString(lb.AvailabilityZones, zone) {
+			lb.AvailabilityZones = append(lb.AvailabilityZones, zone)
+		}
+	}
+	return elb.EnableAvailabilityZonesForLoadBalancerResp{
+		AvailabilityZones: lb.AvailabilityZones,
+		RequestId:         reqId,
+	}, nil
+}
+
+func (srv *Server) disableAvailabilityZonesForLoadBalancer(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
+	lb, zones, err := srv.availabilityZonesRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	remaining := []string{}
+	for _, zone := range lb.AvailabilityZones {
+		if !containsString(zones, zone) {
+			remaining = append(remaining, zone)
+		}
+	}
+	if len(remaining) == 0 && len(lb.AvailabilityZones) > 0 {
+		return nil, &elb.Error{
+			StatusCode: 400,
+			Code:       "ValidationError",
+			Message:    "Cannot remove all Availability Zones from a load balancer.",
+		}
+	}
+	lb.AvailabilityZones = remaining
+	return elb.DisableAvailabilityZonesForLoadBalancerResp{
+		AvailabilityZones: lb.AvailabilityZones,
+		RequestId:         reqId,
+	}, nil
+}
+
+// availabilityZonesRequest returns the load balancer and zones of a request
+// to enable or disable zones.
+func (srv *Server) availabilityZonesRequest(req *http.Request) (*elb.LoadBalancer, []string, error) {
+	required := []string{"LoadBalancerName", "AvailabilityZones.member.1"}
+	if err := srv.validate(req, required); err != nil {
+		return nil, nil, err
+	}
+	lbName := req.FormValue("LoadBalancerName")
+	if err := srv.lbExists(lbName); err != nil {
+		return nil, nil, err
+	}
+	lb := srv.lbs[lbName]
+	if len(lb.Subnets) > 0 {
+		return nil, nil, &elb.Error{
+			StatusCode: 400,
+			Code:       "ValidationError",
+			Message:    "Availability Zones do not apply to load balancers in a VPC, which use subnets.",
+		}
+	}
+	return lb, srv.getParameters("AvailabilityZones.member.", req.Form), nil
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultAttributes are the attributes of a load balancer that hasn't had
+// them modified.
+var defaultAttributes = elb.LoadBalancerAttributes{
+	ConnectionSettingsIdleTimeout: 60,
+	ConnectionDraining:            elb.ConnectionDraining{Timeout: 300},
+}
+
+func (srv *Server) modifyLoadBalancerAttributes(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
+	if err := srv.validate(req, []string{"LoadBalancerName"}); err != nil {
+		return nil, err
+	}
+	lbName := req.FormValue("LoadBalancerName")
+	if err := srv.lbExists(lbName); err != nil {
+		return nil, err
+	}
+	attrs, ok := srv.lbAttrs[lbName]
+	if !ok {
+		attrs = defaultAttributes
+	}
+	var err error
+	parseBool := func(name string, value *bool) {
+		if v := req.FormValue("LoadBalancerAttributes." + name); v != "" && err == nil {
+			if *value, err = strconv.ParseBool(v); err != nil {
+				err = invalidAttribute(name, v)
+			}
+		}
+	}
+	parseInt := func(name string, value *int64, min, max int64) {
+		if v := req.FormValue("LoadBalancerAttributes." + name); v != "" && err == nil {
+			n, e := strconv.ParseInt(v, 10, 64)
+			if e != nil || n < min || n > max {
+				err = invalidAttribute(name, v)
+				return
+			}
+			*value = n
+		}
+	}
+	parseBool("CrossZoneLoadBalancing.Enabled", &attrs.CrossZoneLoadBalancingEnabled)
+	parseInt("ConnectionSettings.IdleTimeout", &attrs.ConnectionSettingsIdleTimeout, 1, 3600)
+	parseBool("ConnectionDraining.Enabled", &attrs.ConnectionDraining.Enabled)
+	parseInt("ConnectionDraining.Timeout", &attrs.ConnectionDraining.Timeout, 1, 3600)
+	parseBool("AccessLog.Enabled", &attrs.AccessLog.Enabled)
+	if err != nil {
+		return nil, err
+	}
+	// The rest of the access log settings only apply while it's enabled;
+	// otherwise the stored ones are kept as they are.
+	if attrs.AccessLog.Enabled {
+		if v := req.FormValue("LoadBalancerAttributes.AccessLog.EmitInterval"); v != "" {
+			if v != "5" && v != "60" {
+				return nil, invalidAttribute("AccessLog.EmitInterval", v)
+			}
+			attrs.AccessLog.EmitInterval, _ = strconv.ParseInt(v, 10, 64)
+		}
+		if attrs.AccessLog.EmitInterval == 0 {
+			attrs.AccessLog.EmitInterval = 60
+		}
+		if v, ok := req.Form["LoadBalancerAttributes.AccessLog.S3BucketName"]; ok {
+			attrs.AccessLog.S3BucketName = v[0]
+		}
+		if v, ok := req.Form["LoadBalancerAttributes.AccessLog.S3BucketPrefix"]; ok {
+			attrs.AccessLog.S3BucketPrefix = v[0]
+		}
+	}
+	srv.lbAttrs[lbName] = attrs
+	return elb.SimpleResp{RequestId: reqId}, nil
+}
+
+func invalidAttribute(name, value string) error {
+	return &elb.Error{
+		StatusCode: 400,
+		Code:       "ValidationError",
+		Message:    fmt.Sprintf("Invalid value for %s: %s", name, value),
+	}
+}
+
+func (srv *Server) describeLoadBalancerAttributes(w http.ResponseWriter, req *http.Request, reqId string) (interface{}, error) {
+	if err := srv.validate(req, []string{"LoadBalancerName"}); err != nil {
+		return nil, err
+	}
+	lbName := req.FormValue("LoadBalancerName")
+	if err := srv.lbExists(lbName); err != nil {
+		return nil, err
+	}
+	attrs, ok := srv.lbAttrs[lbName]
+	if !ok {
+		attrs = defaultAttributes
+	}
+	return elb.DescribeLoadBalancerAttributesResp{
+		LoadBalancerAttributes: attrs,
+		RequestId:              reqId,
+	}, nil
+}
+
+// Load balancer names have up to 32 alphanumerics and hyphens, and neither
+// begin nor end with a hyphen.
+var loadBalancerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,30}[a-zA-Z0-9])?$`)
+
+func validateLoadBalancerName(name string) error {
+	if !loadBalancerNamePattern.MatchString(name) {
+		return &elb.Error{
+			StatusCode: 400,
+			Code:       "ValidationError",
+			Message:    fmt.Sprintf("LoadBalancerName %q must have at most 32 alphanumeric characters or hyphens, and must not begin or end with a hyphen", name),
+		}
+	}
+	return nil
+}
+
+var instanceIdPattern = regexp.MustCompile(`^i-[0-9a-f]+$`)
+
+// validateInstanceId checks id is formed like an EC2 instance id, whether or
+// not the instance exists.
+func validateInstanceId(id string) error {
+	if !instanceIdPattern.MatchString(id) {
+		return &elb.Error{
+			StatusCode: 400,
+			Code:       "InvalidInstance",
+			Message:    fmt.Sprintf("Invalid id: \"%s\" (expecting \"i-...\")", id),
+		}
+	}
+	return nil
+}
+
 func (srv *Server) instanceExists(id string) error {
 	for _, instId := range srv.instances {
 		if instId == id {
@@ -614,55 +2132,310 @@ func (srv *Server) validateComposition(req *http.Request, composition map[string
 
 // Creates a fake instance in the server
 func (srv *Server) NewInstance() string {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.newInstance()
+}
+
+// Creates a fake instance in the given availability zone and returns its id
+func (srv *Server) NewInstanceInZone(zone string) string {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	instId := srv.newInstance()
+	srv.instanceZones[instId] = zone
+	return instId
+}
+
+func (srv *Server) newInstance() string {
 	srv.instCount++
 	instId := fmt.Sprintf("i-%d", srv.instCount)
 	srv.instances = append(srv.instances, instId)
 	return instId
 }
 
+// Returns the availability zone of a fake instance, if it was created in one
+func (srv *Server) InstanceZone(instId string) (string, bool) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	zone, ok := srv.instanceZones[instId]
+	return zone, ok
+}
+
 // Removes a fake instance from the server
 //
 // If no instance is found it does nothing
 func (srv *Server) RemoveInstance(instId string) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
 	for i, id := range srv.instances {
 		if id == instId {
 			srv.instances[i], srv.instances = srv.instances[len(srv.instances)-1], srv.instances[:len(srv.instances)-1]
 		}
 	}
+	delete(srv.instanceZones, instId)
 }
 
 // Creates a fake load balancer in the fake server
+//
+// If a load balancer with the same name exists it does nothing
 func (srv *Server) NewLoadBalancer(name string) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if _, ok := srv.lbs[name]; ok {
+		srv.logf("Fake ELB server can't create %s: a load balancer with that name exists", name)
+		return
+	}
 	srv.lbs[name] = &elb.LoadBalancer{
-		LoadBalancerName: name,
-		DNSName:          fmt.Sprintf("%s-some-aws-stuff.sa-east-1.amazonaws.com", name),
+		LoadBalancerName:    name,
+		DNSName:             fmt.Sprintf("%s-some-aws-stuff.sa-east-1.amazonaws.com", name),
+		HostedZoneNameID:    hostedZoneNameID("sa-east-1"),
+		HealthCheck:         srv.makeHealthCheck(url.Values{}),
+		CreatedTime:         now(),
+		SourceSecurityGroup: sourceSecurityGroup(name),
+	}
+	srv.lbs[name].HostedZoneName = canonicalHostedZoneName(srv.lbs[name])
+}
+
+// Adds a copy of a fully configured load balancer to the fake server
+//
+// A load balancer with the same name is replaced, along with its tags,
+// policies, attributes and instance states. DNSName, HostedZoneNameID,
+// HostedZoneName and SourceSecurityGroup are generated when lb doesn't set
+// them, a zero HealthCheck is replaced by the default one AWS gives load
+// balancers, and the instances of lb start in the state of newly registered
+// instances.
+func (srv *Server) AddLoadBalancer(lb elb.LoadBalancer) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.removeLoadBalancer(lb.LoadBalancerName)
+	stored := copyLoadBalancer(lb)
+	if stored.DNSName == "" {
+		stored.DNSName = fmt.Sprintf("%s-some-aws-stuff.sa-east-1.amazonaws.com", lb.LoadBalancerName)
+	}
+	if stored.HostedZoneNameID == "" {
+		stored.HostedZoneNameID = hostedZoneNameID("sa-east-1")
+	}
+	if stored.HostedZoneName == "" {
+		stored.HostedZoneName = canonicalHostedZoneName(stored)
+	}
+	if stored.HealthCheck == (elb.HealthCheck{}) {
+		stored.HealthCheck = srv.makeHealthCheck(url.Values{})
+	}
+	if stored.CreatedTime.IsZero() {
+		stored.CreatedTime = now()
 	}
+	if stored.SourceSecurityGroup == (elb.SourceSecurityGroup{}) {
+		stored.SourceSecurityGroup = sourceSecurityGroup(lb.LoadBalancerName)
+	}
+	srv.lbs[lb.LoadBalancerName] = stored
+	states := []*elb.InstanceState{}
+	for _, instance := range lb.Instances {
+		states = append(states, srv.makeInstanceState(instance.InstanceId))
+	}
+	srv.instanceStates[lb.LoadBalancerName] = states
+}
+
+// copyLoadBalancer returns a deep copy of lb.
+func copyLoadBalancer(lb elb.LoadBalancer) *elb.LoadBalancer {
+	copied := lb
+	copied.Listeners = nil
+	for _, listener := range lb.Listeners {
+		listener.PolicyNames = copyStrings(listener.PolicyNames)
+		copied.Listeners = append(copied.Listeners, listener)
+	}
+	copied.BackendServerDescriptions = nil
+	for _, backend := range lb.BackendServerDescriptions {
+		backend.PolicyNames = copyStrings(backend.PolicyNames)
+		copied.BackendServerDescriptions = append(copied.BackendServerDescriptions, backend)
+	}
+	if lb.Instances != nil {
+		copied.Instances = append([]elb.Instance{}, lb.Instances...)
+	}
+	copied.AvailabilityZones = copyStrings(lb.AvailabilityZones)
+	copied.SecurityGroups = copyStrings(lb.SecurityGroups)
+	copied.Subnets = copyStrings(lb.Subnets)
+	return &copied
+}
+
+// AssertLoadBalancer returns an error listing the fields of the named load
+// balancer that differ from expected, if any. Fields left as zero values in
+// expected, such as the DNSName and CreatedTime generated by the server, are
+// not compared.
+func (srv *Server) AssertLoadBalancer(name string, expected elb.LoadBalancer) error {
+	srv.mutex.Lock()
+	lb, ok := srv.lbs[name]
+	if ok {
+		lb = copyLoadBalancer(*lb)
+	}
+	srv.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("load balancer %s not found", name)
+	}
+	got := reflect.ValueOf(*lb)
+	want := reflect.ValueOf(expected)
+	var diffs []string
+	for i := 0; i < want.NumField(); i++ {
+		if want.Field(i).IsZero() {
+			continue
+		}
+		if g, w := got.Field(i).Interface(), want.Field(i).Interface(); !reflect.DeepEqual(g, w) {
+			diffs = append(diffs, fmt.Sprintf("%s: got %+v, expected %+v", want.Type().Field(i).Name, g, w))
+		}
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("load balancer %s differs:\n\t%s", name, strings.Join(diffs, "\n\t"))
+	}
+	return nil
+}
+
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
 }
 
 // Removes a fake load balancer from the fake server
 func (srv *Server) RemoveLoadBalancer(name string) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.removeLoadBalancer(name)
+}
+
+// removeLoadBalancer drops a load balancer with everything kept about it,
+// deregistering its instances as AWS does, so that a load balancer created
+// later with the same name starts afresh.
+func (srv *Server) removeLoadBalancer(name string) {
 	delete(srv.lbs, name)
+	delete(srv.instanceStates, name)
+	delete(srv.lbTags, name)
+	delete(srv.lbPolicies, name)
+	delete(srv.healthChecks, name)
+	delete(srv.lbAttrs, name)
+	delete(srv.unconverged, name)
+	delete(srv.stateScripts, name)
+}
+
+// Reports whether the health check of a fake load balancer was explicitly
+// configured through ConfigureHealthCheck
+//
+// Balancers that were never configured still describe the default health
+// check, as AWS does.
+func (srv *Server) HealthCheckConfigured(lbName string) bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.healthChecks[lbName]
+}
+
+// trafficSamples is the number of requests spread across instances by
+// TrafficDistribution.
+const trafficSamples = 1200
+
+// Reports how many of a fixed sample of requests each instance registered with
+// a fake load balancer would serve
+//
+// Without cross-zone load balancing, requests are split evenly between the
+// availability zones that have instances, then between the instances of each
+// zone. With it, they are split evenly between all instances. Instances
+// created without a zone are assigned the zones of the load balancer in turn,
+// in registration order.
+func (srv *Server) TrafficDistribution(lbName string) map[string]int {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	lb, ok := srv.lbs[lbName]
+	if !ok || len(lb.Instances) == 0 {
+		return nil
+	}
+	attrs, ok := srv.lbAttrs[lbName]
+	if !ok {
+		attrs = defaultAttributes
+	}
+	var zones []string
+	zoneInstances := make(map[string][]string)
+	for i, instance := range lb.Instances {
+		zone, ok := srv.instanceZones[instance.InstanceId]
+		if !ok && len(lb.AvailabilityZones) > 0 {
+			zone = lb.AvailabilityZones[i%len(lb.AvailabilityZones)]
+		}
+		if attrs.CrossZoneLoadBalancingEnabled {
+			zone = ""
+		}
+		if _, ok := zoneInstances[zone]; !ok {
+			zones = append(zones, zone)
+		}
+		zoneInstances[zone] = append(zoneInstances[zone], instance.InstanceId)
+	}
+	distribution := make(map[string]int)
+	next := make(map[string]int)
+	for i := 0; i < trafficSamples; i++ {
+		zone := zones[i%len(zones)]
+		instances := zoneInstances[zone]
+		distribution[instances[next[zone]%len(instances)]]++
+		next[zone]++
+	}
+	return distribution
 }
 
 // Register a fake instance with a fake Load Balancer
 //
 // If the Load Balancer does not exists it does nothing
 func (srv *Server) RegisterInstance(instId, lbName string) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
 	lb, ok := srv.lbs[lbName]
 	if !ok {
-		fmt.Println("lb not found :/")
+		srv.logf("Fake ELB server can't register %s: no load balancer named %s", instId, lbName)
+		return
+	}
+	if hasInstance(lb, instId) {
 		return
 	}
 	lb.Instances = append(lb.Instances, elb.Instance{InstanceId: instId})
 	srv.instanceStates[lbName] = append(srv.instanceStates[lbName], srv.makeInstanceState(instId))
 }
 
+// Deregister a fake instance from a fake Load Balancer
+//
+// If the Load Balancer does not exists it does nothing
 func (srv *Server) DeregisterInstance(instId, lbName string) {
-	removeInstanceFromLB(srv.lbs[lbName], instId)
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	lb, ok := srv.lbs[lbName]
+	if !ok {
+		return
+	}
+	removeInstanceFromLB(lb, instId)
 	srv.removeInstanceStatesFromLoadBalancer(lbName, instId)
 }
 
+// Returns the ids of the instances registered with a fake Load Balancer
+//
+// If the Load Balancer does not exists it returns an empty slice
+func (srv *Server) RegisteredInstances(lbName string) []string {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	ids := []string{}
+	if lb, ok := srv.lbs[lbName]; ok {
+		for _, instance := range lb.Instances {
+			ids = append(ids, instance.InstanceId)
+		}
+	}
+	return ids
+}
+
+// Reports whether a fake instance is registered with a fake Load Balancer
+func (srv *Server) IsRegistered(lbName, instId string) bool {
+	for _, id := range srv.RegisteredInstances(lbName) {
+		if id == instId {
+			return true
+		}
+	}
+	return false
+}
+
 func (srv *Server) ChangeInstanceState(lb string, state elb.InstanceState) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
 	states := srv.instanceStates[lb]
 	for i, s := range states {
 		if s.InstanceId == state.InstanceId {
@@ -672,17 +2445,84 @@ func (srv *Server) ChangeInstanceState(lb string, state elb.InstanceState) {
 	}
 }
 
+// Scripts the states an instance registered with a fake load balancer goes
+// through
+//
+// Each DescribeInstanceHealth call describing the instance moves it to the
+// next state of states, whose InstanceIds are ignored. The instance stays in
+// the last state once the script is done. An empty script cancels it.
+func (srv *Server) ScriptInstanceStates(lb, instId string, states []elb.InstanceState) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if len(states) == 0 {
+		delete(srv.stateScripts[lb], instId)
+		return
+	}
+	if srv.stateScripts[lb] == nil {
+		srv.stateScripts[lb] = make(map[string][]elb.InstanceState)
+	}
+	srv.stateScripts[lb][instId] = append([]elb.InstanceState(nil), states...)
+}
+
+// Marks an instance registered with a fake load balancer as InService
+func (srv *Server) SetInstanceInService(lb, instId string) error {
+	return srv.setInstanceState(lb, elb.InstanceState{
+		InstanceId:  instId,
+		State:       elb.StateInService,
+		ReasonCode:  elb.ReasonCodeNA,
+		Description: "N/A",
+	})
+}
+
+// Marks an instance registered with a fake load balancer as OutOfService
+//
+// An empty description defaults to the one AWS gives failing instances.
+func (srv *Server) SetInstanceOutOfService(lb, instId, reasonCode, description string) error {
+	if description == "" {
+		description = "Instance has failed at least the UnhealthyThreshold number of health checks consecutively."
+	}
+	return srv.setInstanceState(lb, elb.InstanceState{
+		InstanceId:  instId,
+		State:       elb.StateOutOfService,
+		ReasonCode:  reasonCode,
+		Description: description,
+	})
+}
+
+func (srv *Server) setInstanceState(lb string, state elb.InstanceState) error {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	for i, s := range srv.instanceStates[lb] {
+		if s.InstanceId == state.InstanceId {
+			srv.instanceStates[lb][i] = &state
+			return nil
+		}
+	}
+	return fmt.Errorf("instance %s is not registered with load balancer %s", state.InstanceId, lb)
+}
+
 var actions = map[string]func(*Server, http.ResponseWriter, *http.Request, string) (interface{}, error){
-	"CreateLoadBalancer":                    (*Server).createLoadBalancer,
-	"DeleteLoadBalancer":                    (*Server).deleteLoadBalancer,
-	"RegisterInstancesWithLoadBalancer":     (*Server).registerInstancesWithLoadBalancer,
-	"DeregisterInstancesFromLoadBalancer":   (*Server).deregisterInstancesFromLoadBalancer,
-	"DescribeLoadBalancers":                 (*Server).describeLoadBalancers,
-	"DescribeInstanceHealth":                (*Server).describeInstanceHealth,
-	"ConfigureHealthCheck":                  (*Server).configureHealthCheck,
-	"AddTags":                               (*Server).addTags,
-	"DescribeTags":                          (*Server).describeTags,
-	"CreateLoadBalancerListeners":           (*Server).createLoadBalancerListeners,
-	"DeleteLoadBalancerListeners":           (*Server).deleteLoadBalancerListeners,
-	"SetLoadBalancerListenerSSLCertificate": (*Server).setLoadBalancerListenerSSLCertificate,
+	"CreateLoadBalancer":                      (*Server).createLoadBalancer,
+	"DeleteLoadBalancer":                      (*Server).deleteLoadBalancer,
+	"RegisterInstancesWithLoadBalancer":       (*Server).registerInstancesWithLoadBalancer,
+	"DeregisterInstancesFromLoadBalancer":     (*Server).deregisterInstancesFromLoadBalancer,
+	"DescribeLoadBalancers":                   (*Server).describeLoadBalancers,
+	"DescribeInstanceHealth":                  (*Server).describeInstanceHealth,
+	"ConfigureHealthCheck":                    (*Server).configureHealthCheck,
+	"AddTags":                                 (*Server).addTags,
+	"DescribeTags":                            (*Server).describeTags,
+	"RemoveTags":                              (*Server).removeTags,
+	"CreateLoadBalancerListeners":             (*Server).createLoadBalancerListeners,
+	"DeleteLoadBalancerListeners":             (*Server).deleteLoadBalancerListeners,
+	"SetLoadBalancerListenerSSLCertificate":   (*Server).setLoadBalancerListenerSSLCertificate,
+	"DescribeLoadBalancerPolicyTypes":         (*Server).describeLoadBalancerPolicyTypes,
+	"CreateLoadBalancerPolicy":                (*Server).createLoadBalancerPolicy,
+	"DeleteLoadBalancerPolicy":                (*Server).deleteLoadBalancerPolicy,
+	"DescribeLoadBalancerPolicies":            (*Server).describeLoadBalancerPolicies,
+	"SetLoadBalancerPoliciesOfListener":       (*Server).setLoadBalancerPoliciesOfListener,
+	"SetLoadBalancerPoliciesForBackendServer": (*Server).setLoadBalancerPoliciesForBackendServer,
+	"ModifyLoadBalancerAttributes":            (*Server).modifyLoadBalancerAttributes,
+	"DescribeLoadBalancerAttributes":          (*Server).describeLoadBalancerAttributes,
+	"EnableAvailabilityZonesForLoadBalancer":  (*Server).enableAvailabilityZonesForLoadBalancer,
+	"DisableAvailabilityZonesForLoadBalancer": (*Server).disableAvailabilityZonesForLoadBalancer,
 }
@@ -0,0 +1,260 @@
+package elbtest_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/pivotal-cloudops/cloudops-goamz/aws"
+	"github.com/pivotal-cloudops/cloudops-goamz/elb"
+	"github.com/pivotal-cloudops/cloudops-goamz/elb/elbtest"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct {
+	srv *elbtest.Server
+	elb *elb.ELB
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpTest(c *C) {
+	srv, err := elbtest.NewServer()
+	c.Assert(err, IsNil)
+	s.srv = srv
+	s.elb = elb.New(aws.Auth{AccessKey: "key", SecretKey: "secret"}, aws.Region{ELBEndpoint: srv.URL()})
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.srv.Quit()
+}
+
+func (s *S) createLoadBalancer(c *C, name string) {
+	_, err := s.elb.CreateLoadBalancer(&elb.CreateLoadBalancer{
+		LoadBalancerName: name,
+		AvailZone:        []string{"us-east-1a"},
+		Listeners: []elb.Listener{{
+			InstancePort:     80,
+			InstanceProtocol: "HTTP",
+			LoadBalancerPort: 80,
+			Protocol:         "HTTP",
+		}},
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *S) instanceStates(c *C, lbName string) []elb.InstanceState {
+	resp, err := s.elb.DescribeInstanceHealth(&elb.DescribeInstanceHealth{LoadBalancerName: lbName})
+	c.Assert(err, IsNil)
+	return resp.InstanceStates
+}
+
+func (s *S) TestRegisterInstancesValidatesEveryIdFirst(c *C) {
+	s.createLoadBalancer(c, "testlb")
+	instId := s.srv.NewInstance()
+	_, err := s.elb.RegisterInstancesWithLoadBalancer(&elb.RegisterInstancesWithLoadBalancer{
+		LoadBalancerName: "testlb",
+		Instances:        []string{instId, "i-999"},
+	})
+	e, ok := err.(*elb.Error)
+	c.Assert(ok, Equals, true)
+	c.Assert(e.Code, Equals, "InvalidInstance")
+	c.Assert(s.srv.RegisteredInstances("testlb"), DeepEquals, []string{})
+	c.Assert(s.instanceStates(c, "testlb"), HasLen, 0)
+}
+
+func (s *S) TestRegisterInstancesSkipsRegisteredInstances(c *C) {
+	s.createLoadBalancer(c, "testlb")
+	instId := s.srv.NewInstance()
+	for i := 0; i < 2; i++ {
+		_, err := s.elb.RegisterInstancesWithLoadBalancer(&elb.RegisterInstancesWithLoadBalancer{
+			LoadBalancerName: "testlb",
+			Instances:        []string{instId},
+		})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(s.srv.RegisteredInstances("testlb"), DeepEquals, []string{instId})
+	c.Assert(s.instanceStates(c, "testlb"), HasLen, 1)
+	_, err := s.elb.DeregisterInstancesFromLoadBalancer(&elb.DeregisterInstancesFromLoadBalancer{
+		LoadBalancerName: "testlb",
+		Instances:        []string{instId},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(s.srv.RegisteredInstances("testlb"), DeepEquals, []string{})
+	c.Assert(s.instanceStates(c, "testlb"), HasLen, 0)
+}
+
+func (s *S) TestDeregisterInstancesValidatesEveryIdFirst(c *C) {
+	s.createLoadBalancer(c, "testlb")
+	instId := s.srv.NewInstance()
+	s.srv.RegisterInstance(instId, "testlb")
+	_, err := s.elb.DeregisterInstancesFromLoadBalancer(&elb.DeregisterInstancesFromLoadBalancer{
+		LoadBalancerName: "testlb",
+		Instances:        []string{instId, "i-999"},
+	})
+	c.Assert(err, NotNil)
+	c.Assert(s.srv.RegisteredInstances("testlb"), DeepEquals, []string{instId})
+	c.Assert(s.instanceStates(c, "testlb"), HasLen, 1)
+}
+
+func (s *S) TestDefaultInstanceState(c *C) {
+	s.createLoadBalancer(c, "testlb")
+	s.srv.SetDefaultInstanceState(elb.InstanceState{State: elb.StateInService})
+	instId := s.srv.NewInstance()
+	s.srv.RegisterInstance(instId, "testlb")
+	states := s.instanceStates(c, "testlb")
+	c.Assert(states, HasLen, 1)
+	c.Assert(states[0].InstanceId, Equals, instId)
+	c.Assert(states[0].State, Equals, elb.StateInService)
+}
+
+func (s *S) TestScriptInstanceStates(c *C) {
+	s.createLoadBalancer(c, "testlb")
+	instId := s.srv.NewInstance()
+	s.srv.RegisterInstance(instId, "testlb")
+	s.srv.ScriptInstanceStates("testlb", instId, []elb.InstanceState{
+		{State: elb.StateOutOfService},
+		{State: elb.StateInService},
+	})
+	c.Assert(s.instanceStates(c, "testlb")[0].State, Equals, elb.StateOutOfService)
+	c.Assert(s.instanceStates(c, "testlb")[0].State, Equals, elb.StateInService)
+	c.Assert(s.instanceStates(c, "testlb")[0].State, Equals, elb.StateInService)
+}
+
+func (s *S) TestDescribeLoadBalancersPages(c *C) {
+	for _, name := range []string{"lb-c", "lb-a", "lb-b"} {
+		s.createLoadBalancer(c, name)
+	}
+	resp, err := s.elb.DescribeLoadBalancers(&elb.DescribeLoadBalancer{PageSize: 2})
+	c.Assert(err, IsNil)
+	c.Assert(resp.LoadBalancers, HasLen, 2)
+	c.Assert(resp.LoadBalancers[0].LoadBalancerName, Equals, "lb-a")
+	c.Assert(resp.NextMarker, Equals, "lb-c")
+	resp, err = s.elb.DescribeLoadBalancers(&elb.DescribeLoadBalancer{PageSize: 2, Marker: resp.NextMarker})
+	c.Assert(err, IsNil)
+	c.Assert(resp.LoadBalancers, HasLen, 1)
+	c.Assert(resp.NextMarker, Equals, "")
+	resp, err = s.elb.DescribeLoadBalancers(&elb.DescribeLoadBalancer{PageSize: 1000})
+	c.Assert(err, IsNil)
+	c.Assert(resp.LoadBalancers, HasLen, 3)
+}
+
+func (s *S) TestDescribeLoadBalancersByName(c *C) {
+	s.createLoadBalancer(c, "testlb")
+	s.createLoadBalancer(c, "otherlb")
+	resp, err := s.elb.DescribeLoadBalancers(&elb.DescribeLoadBalancer{Names: []string{"testlb"}})
+	c.Assert(err, IsNil)
+	c.Assert(resp.LoadBalancers, HasLen, 1)
+	c.Assert(resp.LoadBalancers[0].LoadBalancerName, Equals, "testlb")
+	_, err = s.elb.DescribeLoadBalancers(&elb.DescribeLoadBalancer{Names: []string{"unknown"}})
+	e, ok := elb.AsError(err)
+	c.Assert(ok, Equals, true)
+	c.Assert(e.IsNotFound(), Equals, true)
+}
+
+func (s *S) TestCreatedTimeHasThreeFractionDigits(c *C) {
+	s.createLoadBalancer(c, "testlb")
+	resp, err := http.PostForm(s.srv.URL(), url.Values{"Action": {"DescribeLoadBalancers"}})
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Assert(regexp.MustCompile(`<CreatedTime>\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}Z</CreatedTime>`).Match(body), Equals, true)
+}
+
+func (s *S) TestDisableAvailabilityZones(c *C) {
+	s.createLoadBalancer(c, "testlb")
+	_, err := s.elb.EnableAvailabilityZonesForLoadBalancer(&elb.EnableAvailabilityZonesForLoadBalancer{
+		LoadBalancerName:  "testlb",
+		AvailabilityZones: []string{"us-east-1b"},
+	})
+	c.Assert(err, IsNil)
+	resp, err := s.elb.DisableAvailabilityZonesForLoadBalancer(&elb.DisableAvailabilityZonesForLoadBalancer{
+		LoadBalancerName:  "testlb",
+		AvailabilityZones: []string{"us-east-1a"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resp.AvailabilityZones, DeepEquals, []string{"us-east-1b"})
+	_, err = s.elb.DisableAvailabilityZonesForLoadBalancer(&elb.DisableAvailabilityZonesForLoadBalancer{
+		LoadBalancerName:  "testlb",
+		AvailabilityZones: []string{"us-east-1b"},
+	})
+	c.Assert(err, ErrorMatches, ".*Cannot remove all Availability Zones.*")
+}
+
+func (s *S) TestDisableAvailabilityZonesOfBalancerWithoutZones(c *C) {
+	s.srv.NewLoadBalancer("testlb")
+	resp, err := s.elb.DisableAvailabilityZonesForLoadBalancer(&elb.DisableAvailabilityZonesForLoadBalancer{
+		LoadBalancerName:  "testlb",
+		AvailabilityZones: []string{"us-east-1a"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resp.AvailabilityZones, HasLen, 0)
+}
+
+func (s *S) TestAddLoadBalancerReplacesExistingOne(c *C) {
+	s.createLoadBalancer(c, "testlb")
+	_, err := s.elb.AddTags(&elb.AddTags{
+		LoadBalancerNames: []string{"testlb"},
+		Tags:              []elb.Tag{{Key: "env", Value: "test"}},
+	})
+	c.Assert(err, IsNil)
+	s.srv.AddLoadBalancer(elb.LoadBalancer{LoadBalancerName: "testlb"})
+	resp, err := s.elb.DescribeTags(&elb.DescribeTags{LoadBalancerNames: []string{"testlb"}})
+	c.Assert(err, IsNil)
+	c.Assert(resp.LoadBalancerTags, HasLen, 1)
+	c.Assert(resp.LoadBalancerTags[0].Tags, HasLen, 0)
+}
+
+func (s *S) TestReset(c *C) {
+	s.createLoadBalancer(c, "testlb")
+	s.srv.Reset()
+	resp, err := s.elb.DescribeLoadBalancers(&elb.DescribeLoadBalancer{})
+	c.Assert(err, IsNil)
+	c.Assert(resp.LoadBalancers, HasLen, 0)
+	c.Assert(s.srv.Operations(), DeepEquals, []string{"DescribeLoadBalancers"})
+}
+
+func (s *S) TestAuthError(c *C) {
+	s.srv.SetAuthError(&elb.Error{StatusCode: 403, Code: "InvalidClientTokenId", Message: "bad token"})
+	_, err := s.elb.DescribeLoadBalancers(&elb.DescribeLoadBalancer{})
+	e, ok := elb.AsError(err)
+	c.Assert(ok, Equals, true)
+	c.Assert(e.Code, Equals, "InvalidClientTokenId")
+	s.srv.SetAuthError(nil)
+	_, err = s.elb.DescribeLoadBalancers(&elb.DescribeLoadBalancer{})
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestConcurrentRequests(c *C) {
+	s.createLoadBalancer(c, "testlb")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			instId := s.srv.NewInstance()
+			s.elb.RegisterInstancesWithLoadBalancer(&elb.RegisterInstancesWithLoadBalancer{
+				LoadBalancerName: "testlb",
+				Instances:        []string{instId},
+			})
+			s.srv.ChangeInstanceState("testlb", elb.InstanceState{InstanceId: instId, State: elb.StateInService})
+		}()
+		go func() {
+			defer wg.Done()
+			s.elb.DescribeInstanceHealth(&elb.DescribeInstanceHealth{LoadBalancerName: "testlb"})
+			s.srv.RegisteredInstances("testlb")
+			s.srv.Operations()
+		}()
+	}
+	wg.Wait()
+	c.Assert(s.srv.RegisteredInstances("testlb"), HasLen, 10)
+	c.Assert(s.srv.Operations(), HasLen, 21)
+}
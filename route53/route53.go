@@ -4,17 +4,21 @@ package route53
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pivotal-cloudops/cloudops-goamz/aws"
+	"github.com/pivotal-cloudops/cloudops-goamz/elb"
 )
 
 // The Route53 type encapsulates operations operations with the route53 endpoint.
@@ -22,6 +26,14 @@ type Route53 struct {
 	aws.Auth
 	aws.Region
 	httpClient *http.Client
+
+	// ChangeLogger, when set, is called with each change of a batch, in
+	// order, just before ChangeResourceRecordSets submits it.
+	ChangeLogger func(Change)
+
+	// ChangeRetryDelay is how long ChangeWithRetry waits before its first
+	// retry, doubling after each. It defaults to half a second.
+	ChangeRetryDelay time.Duration
 }
 
 const APIVersion = "2013-04-01"
@@ -32,7 +44,7 @@ func New(auth aws.Auth, region aws.Region) *Route53 {
 }
 
 func NewWithClient(auth aws.Auth, region aws.Region, httpClient *http.Client) *Route53 {
-	return &Route53{auth, region, httpClient}
+	return &Route53{Auth: auth, Region: region, httpClient: httpClient}
 }
 
 type CreateHostedZoneRequest struct {
@@ -52,13 +64,16 @@ type HostedZone struct {
 	Name            string `xml:"Name"`
 	CallerReference string `xml:"CallerReference"`
 	Comment         string `xml:"Config>Comment"`
-	ResourceCount   int    `xml:"ResourceRecordSetCount"`
+	// ResourceCount counts the record sets of the zone, including the NS
+	// and SOA records Route53 creates with it.
+	ResourceCount int `xml:"ResourceRecordSetCount"`
 }
 
 type ChangeInfo struct {
 	ID          string `xml:"Id"`
 	Status      string `xml:"Status"`
 	SubmittedAt string `xml:"SubmittedAt"`
+	Comment     string `xml:"Comment,omitempty"`
 }
 
 type DelegationSet struct {
@@ -139,15 +154,117 @@ func (r *Route53) query(method, path string, req, resp interface{}) error {
 	case 200:
 	case 201:
 	default:
-		var body bytes.Buffer
-		io.Copy(&body, re.Body)
-		return fmt.Errorf("Request failed, got status code: %d. Response: %s",
-			re.StatusCode, body.Bytes())
+		return buildError(re)
 	}
 
 	// Decode the response
-	decoder := xml.NewDecoder(re.Body)
-	return decoder.Decode(resp)
+	return decodeResponse(re.Body, resp)
+}
+
+// decodeResponse decodes the XML document read from body into resp. A proxy
+// in front of the service may answer with an HTML page instead, which is
+// reported as an error rather than decoded as an empty response.
+func decodeResponse(body io.Reader, resp interface{}) error {
+	decoder := xml.NewDecoder(body)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			if strings.EqualFold(start.Name.Local, "html") {
+				return fmt.Errorf("route53: unexpected HTML response")
+			}
+			return decoder.DecodeElement(resp, &start)
+		}
+	}
+}
+
+type xmlErrors struct {
+	Error     Error  `xml:"Error"`
+	RequestId string `xml:"RequestId"`
+}
+
+func buildError(r *http.Response) error {
+	var (
+		body bytes.Buffer
+		errs xmlErrors
+	)
+	io.Copy(&body, r.Body)
+	xml.Unmarshal(body.Bytes(), &errs)
+	err := errs.Error
+	err.StatusCode = r.StatusCode
+	if err.RequestId == "" {
+		err.RequestId = errs.RequestId
+	}
+	if err.Code == "" {
+		err.Message = fmt.Sprintf("Request failed, got status code: %d. Response: %s",
+			r.StatusCode, body.Bytes())
+	}
+	return &err
+}
+
+// Error encapsulates a Route53 error.
+type Error struct {
+	// HTTP status code of the error.
+	StatusCode int `xml:"-"`
+
+	// Whether the error was caused by the Sender or the Receiver.
+	Type string `xml:"Type"`
+
+	// AWS code of the error.
+	Code string `xml:"Code"`
+
+	// Message explaining the error.
+	Message string `xml:"Message"`
+
+	// AWS request id of the failed request, needed when contacting support.
+	RequestId string `xml:"RequestId"`
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if e.Code != "" {
+		msg = e.Code + ": " + msg
+	}
+	if e.RequestId != "" {
+		msg += " (RequestId: " + e.RequestId + ")"
+	}
+	return msg
+}
+
+// IsNotFound reports whether the hosted zone, change or health check the
+// request refers to doesn't exist.
+func (e *Error) IsNotFound() bool {
+	switch e.Code {
+	case "NoSuchHostedZone", "NoSuchChange", "NoSuchHealthCheck":
+		return true
+	}
+	return false
+}
+
+// IsThrottling reports whether the request was throttled, or rejected while
+// a prior change is processed, and may be retried later.
+func (e *Error) IsThrottling() bool {
+	switch e.Code {
+	case "Throttling", "PriorRequestNotComplete":
+		return true
+	}
+	return false
+}
+
+// IsInvalidChangeBatch reports whether a change batch was rejected because
+// of the changes it holds.
+func (e *Error) IsInvalidChangeBatch() bool {
+	return e.Code == "InvalidChangeBatch"
+}
+
+// AsError returns the first *Error in the chain of err, as unwrapped by
+// errors.As, if there is one.
+func AsError(err error) (*Error, bool) {
+	var e *Error
+	ok := errors.As(err, &e)
+	return e, ok
 }
 
 func multimap(p map[string]string) url.Values {
@@ -245,6 +362,49 @@ func (r *Route53) ListHostedZones(marker string, maxItems int) (*ListHostedZones
 	return out, err
 }
 
+type ListHostedZonesByNameResponse struct {
+	HostedZones  []HostedZone `xml:"HostedZones>HostedZone"`
+	DNSName      string       `xml:"DNSName"`
+	HostedZoneId string       `xml:"HostedZoneId"`
+	IsTruncated  bool         `xml:"IsTruncated"`
+	NextDNSName  string       `xml:"NextDNSName"`
+	MaxItems     int          `xml:"MaxItems"`
+}
+
+// ListHostedZonesByName lists hosted zones ordered by name, starting at
+// dnsName.
+func (r *Route53) ListHostedZonesByName(dnsName string, maxItems int) (*ListHostedZonesByNameResponse, error) {
+	values := url.Values{}
+
+	if dnsName != "" {
+		values.Add("dnsname", dnsName)
+	}
+
+	if maxItems != 0 {
+		values.Add("maxitems", strconv.Itoa(maxItems))
+	}
+
+	out := &ListHostedZonesByNameResponse{}
+	err := r.query("GET", fmt.Sprintf("/%s/hostedzonesbyname", APIVersion), values, out)
+	if err != nil {
+		return nil, err
+	}
+	return out, err
+}
+
+type GetHostedZoneCountResponse struct {
+	HostedZoneCount int `xml:"HostedZoneCount"`
+}
+
+func (r *Route53) GetHostedZoneCount() (int, error) {
+	out := &GetHostedZoneCountResponse{}
+	err := r.query("GET", fmt.Sprintf("/%s/hostedzonecount", APIVersion), nil, out)
+	if err != nil {
+		return 0, err
+	}
+	return out.HostedZoneCount, err
+}
+
 type GetChangeResponse struct {
 	ChangeInfo ChangeInfo `xml:"ChangeInfo"`
 }
@@ -259,6 +419,70 @@ func (r *Route53) GetChange(ID string) (string, error) {
 	return out.ChangeInfo.Status, err
 }
 
+// WaitOptions control how WaitForChange polls a change.
+type WaitOptions struct {
+	// Context, when set, stops the wait once it is done.
+	Context context.Context
+	// Timeout, when positive, bounds how long to wait.
+	Timeout time.Duration
+	// Delay is the wait before the second poll, doubling after each poll
+	// up to MaxDelay. They default to 1 and 30 seconds.
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// A WaitError is returned by WaitForChange when it stops waiting before
+// the change is INSYNC.
+type WaitError struct {
+	ChangeID string
+	Status   string // The last status of the change
+	Err      error  // Why waiting stopped, e.g. context.DeadlineExceeded
+}
+
+func (e *WaitError) Error() string {
+	return fmt.Sprintf("route53: change %s still %s: %v", e.ChangeID, e.Status, e.Err)
+}
+
+// WaitForChange polls the change with the given ID, backing off between
+// polls, until it is INSYNC.
+func (r *Route53) WaitForChange(changeId string, opts WaitOptions) error {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	delay, maxDelay := opts.Delay, opts.MaxDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	if maxDelay <= 0 {
+		maxDelay = 30 * time.Second
+	}
+	for {
+		status, err := r.GetChange(changeId)
+		if err != nil {
+			return err
+		}
+		if status == "INSYNC" {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return &WaitError{ChangeID: CleanChangeID(changeId), Status: status, Err: ctx.Err()}
+		case <-timer.C:
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
 type ChangeResourceRecordSetsRequest struct {
 	Comment string   `xml:"ChangeBatch>Comment,omitempty"`
 	Changes []Change `xml:"ChangeBatch>Changes>Change"`
@@ -280,6 +504,21 @@ type ChangeResourceRecordSetsResponse struct {
 }
 
 func (r *Route53) ChangeResourceRecordSets(zone string,
+	req *ChangeResourceRecordSetsRequest) (*ChangeResourceRecordSetsResponse, error) {
+	r.logChanges(req.Changes)
+	return r.changeResourceRecordSets(zone, req)
+}
+
+// logChanges passes each of changes to the ChangeLogger, if there is one.
+func (r *Route53) logChanges(changes []Change) {
+	if r.ChangeLogger != nil {
+		for _, change := range changes {
+			r.ChangeLogger(change)
+		}
+	}
+}
+
+func (r *Route53) changeResourceRecordSets(zone string,
 	req *ChangeResourceRecordSetsRequest) (*ChangeResourceRecordSetsResponse, error) {
 	// This is really sad, but we have to format this differently
 	// for Route53 to make them happy.
@@ -293,6 +532,65 @@ func (r *Route53) ChangeResourceRecordSets(zone string,
 	return out, nil
 }
 
+// changeRetries is how many times ChangeWithRetry resubmits a batch while
+// Route53 is busy with a prior change.
+const changeRetries = 4
+
+// ChangeWithRetry submits changes to a zone as a batch. While the request is
+// throttled or rejected with PriorRequestNotComplete, which Route53 does
+// without applying the batch, it is resubmitted up to changeRetries times.
+// No deduplication happens: a batch that failed any other way, such as on a
+// dropped connection, may have been applied. The ChangeLogger is called once
+// for each change, before the first attempt.
+func (r *Route53) ChangeWithRetry(zoneId string, changes []Change) (*ChangeResourceRecordSetsResponse, error) {
+	delay := r.ChangeRetryDelay
+	if delay <= 0 {
+		delay = 500 * time.Millisecond
+	}
+	req := &ChangeResourceRecordSetsRequest{Changes: changes}
+	r.logChanges(changes)
+	for attempt := 0; ; attempt++ {
+		resp, err := r.changeResourceRecordSets(zoneId, req)
+		if e, ok := AsError(err); !ok || !e.IsThrottling() || attempt == changeRetries {
+			return resp, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// UpsertAliasForLB creates or updates the alias A record named recordName in
+// the hosted zone zoneId so that it points at the load balancer lb, without
+// evaluating target health. The record must be within the zone. Route53 has
+// no idempotency token for change batches, so none is sent: submitting the
+// same UPSERT again leaves the record as it is.
+func (r *Route53) UpsertAliasForLB(zoneId, recordName string, lb elb.LoadBalancer) (ChangeInfo, error) {
+	zone, err := r.GetHostedZone(zoneId)
+	if err != nil {
+		return ChangeInfo{}, err
+	}
+	name := strings.ToLower(FQDN(recordName))
+	zoneName := strings.ToLower(FQDN(zone.HostedZone.Name))
+	if name != zoneName && !strings.HasSuffix(name, "."+zoneName) {
+		return ChangeInfo{}, fmt.Errorf("record %s is not within hosted zone %s", recordName, zone.HostedZone.Name)
+	}
+	record := ResourceRecordSet{
+		Name: name,
+		Type: "A",
+		AliasTarget: &AliasTarget{
+			HostedZoneId: lb.HostedZoneNameID,
+			DNSName:      FQDN(lb.DNSName),
+		},
+	}
+	resp, err := r.ChangeResourceRecordSets(zoneId, &ChangeResourceRecordSetsRequest{
+		Changes: []Change{{Action: "UPSERT", Record: record}},
+	})
+	if err != nil {
+		return ChangeInfo{}, err
+	}
+	return resp.ChangeInfo, nil
+}
+
 type ListOpts struct {
 	Name       string
 	Type       string
@@ -314,8 +612,10 @@ type ResourceRecordSet struct {
 	Type string `xml:"Type"`
 	TTL  int    `xml:"TTL"`
 	//Records       []string     `xml:"ResourceRecords>ResourceRecord>Value,omitempty"`
-	SetIdentifier string       `xml:"SetIdentifier,omitempty"`
-	Weight        int          `xml:"Weight,omitempty"`
+	SetIdentifier string `xml:"SetIdentifier,omitempty"`
+	// Weight is nil for records that aren't weighted. A weighted record may
+	// have a weight of 0, so that it receives no traffic.
+	Weight        *int         `xml:"Weight,omitempty"`
 	HealthCheckId string       `xml:"HealthCheckId,omitempty"`
 	Region        string       `xml:"Region,omitempty"`
 	Failover      string       `xml:"Failover,omitempty"`
@@ -324,6 +624,34 @@ type ResourceRecordSet struct {
 	RecordsXML string `xml:",innerxml"`
 }
 
+// Values returns the values of the record's resource records, as held in
+// RecordsXML.
+func (rrs ResourceRecordSet) Values() []string {
+	var records struct {
+		Values []string `xml:"ResourceRecords>ResourceRecord>Value"`
+	}
+	xml.Unmarshal([]byte("<ResourceRecordSet>"+rrs.RecordsXML+"</ResourceRecordSet>"), &records)
+	return records.Values
+}
+
+// SetValues replaces the resource records of the record with records holding
+// values.
+func (rrs *ResourceRecordSet) SetValues(values ...string) {
+	if len(values) == 0 {
+		rrs.RecordsXML = ""
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString("<ResourceRecords>")
+	for _, value := range values {
+		buf.WriteString("<ResourceRecord><Value>")
+		xml.EscapeText(&buf, []byte(value))
+		buf.WriteString("</Value></ResourceRecord>")
+	}
+	buf.WriteString("</ResourceRecords>")
+	rrs.RecordsXML = buf.String()
+}
+
 func (r *Route53) ListResourceRecordSets(zone string, lopts *ListOpts) (*ListResourceRecordSetsResponse, error) {
 	if lopts == nil {
 		lopts = &ListOpts{}
@@ -351,6 +679,187 @@ func (r *Route53) ListResourceRecordSets(zone string, lopts *ListOpts) (*ListRes
 	return out, nil
 }
 
+type HealthCheckConfig struct {
+	IPAddress                string `xml:"IPAddress,omitempty"`
+	Port                     int    `xml:"Port,omitempty"`
+	Type                     string `xml:"Type"`
+	ResourcePath             string `xml:"ResourcePath,omitempty"`
+	FullyQualifiedDomainName string `xml:"FullyQualifiedDomainName,omitempty"`
+	RequestInterval          int    `xml:"RequestInterval,omitempty"`
+	FailureThreshold         int    `xml:"FailureThreshold,omitempty"`
+}
+
+type HealthCheck struct {
+	ID                 string            `xml:"Id"`
+	CallerReference    string            `xml:"CallerReference"`
+	HealthCheckConfig  HealthCheckConfig `xml:"HealthCheckConfig"`
+	HealthCheckVersion int               `xml:"HealthCheckVersion"`
+}
+
+type CreateHealthCheckRequest struct {
+	CallerReference   string            `xml:"CallerReference"`
+	HealthCheckConfig HealthCheckConfig `xml:"HealthCheckConfig"`
+}
+
+type CreateHealthCheckResponse struct {
+	HealthCheck HealthCheck `xml:"HealthCheck"`
+}
+
+// CreateHealthCheck is used to create a new health check. Creating a health
+// check with a CallerReference that was already used returns the existing
+// health check.
+func (r *Route53) CreateHealthCheck(req *CreateHealthCheckRequest) (*CreateHealthCheckResponse, error) {
+	// Generate a unique caller reference if none provided
+	if req.CallerReference == "" {
+		req.CallerReference = time.Now().Format(time.RFC3339Nano)
+	}
+	out := &CreateHealthCheckResponse{}
+	if err := r.query("POST", fmt.Sprintf("/%s/healthcheck", APIVersion), req, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type GetHealthCheckResponse struct {
+	HealthCheck HealthCheck `xml:"HealthCheck"`
+}
+
+func (r *Route53) GetHealthCheck(ID string) (*GetHealthCheckResponse, error) {
+	out := &GetHealthCheckResponse{}
+	err := r.query("GET", fmt.Sprintf("/%s/healthcheck/%s", APIVersion, ID), nil, out)
+	if err != nil {
+		return nil, err
+	}
+	return out, err
+}
+
+// ErrNoChanges is returned by Reconcile when the zone already holds the
+// desired records.
+var ErrNoChanges = errors.New("route53: no changes needed")
+
+// Reconcile changes the records of a zone to match desired. Records are
+// identified by name, type and set identifier: desired records missing from
+// the zone are created, those that differ are upserted, and records of the
+// zone that are not desired are deleted. NS and SOA records, which Route53
+// manages, are never deleted.
+//
+// When the zone already matches desired no change is submitted and
+// ErrNoChanges is returned.
+func (r *Route53) Reconcile(zoneId string, desired []ResourceRecordSet) (ChangeInfo, error) {
+	var current []ResourceRecordSet
+	lopts := &ListOpts{}
+	for {
+		resp, err := r.ListResourceRecordSets(zoneId, lopts)
+		if err != nil {
+			return ChangeInfo{}, err
+		}
+		current = append(current, resp.Records...)
+		if !resp.IsTruncated {
+			break
+		}
+		lopts = &ListOpts{
+			Name:       resp.NextRecordName,
+			Type:       resp.NextRecordType,
+			Identifier: resp.NextRecordIdentifier,
+		}
+	}
+
+	existing := make(map[string]ResourceRecordSet, len(current))
+	for _, record := range current {
+		record.SetValues(record.Values()...)
+		existing[recordKey(record)] = record
+	}
+
+	var changes []Change
+	wanted := make(map[string]bool, len(desired))
+	for _, record := range desired {
+		key := recordKey(record)
+		wanted[key] = true
+		if old, ok := existing[key]; !ok {
+			changes = append(changes, Change{Action: "CREATE", Record: record})
+		} else if !sameRecord(old, record) {
+			changes = append(changes, Change{Action: "UPSERT", Record: record})
+		}
+	}
+	for _, record := range current {
+		key := recordKey(record)
+		if wanted[key] || record.Type == "NS" || record.Type == "SOA" {
+			continue
+		}
+		changes = append(changes, Change{Action: "DELETE", Record: existing[key]})
+	}
+
+	if len(changes) == 0 {
+		return ChangeInfo{}, ErrNoChanges
+	}
+	resp, err := r.ChangeResourceRecordSets(zoneId, &ChangeResourceRecordSetsRequest{Changes: changes})
+	if err != nil {
+		return ChangeInfo{}, err
+	}
+	return resp.ChangeInfo, nil
+}
+
+// recordKey identifies a record by its name, type and set identifier.
+func recordKey(record ResourceRecordSet) string {
+	return normalizeName(record.Name) + " " + record.Type + " " + record.SetIdentifier
+}
+
+// normalizeName returns name in the form Route53 lists it, fully qualified and
+// lower case, though with the asterisk of a wildcard unescaped: Route53 lists
+// *.example.com. as \052.example.com.
+func normalizeName(name string) string {
+	return strings.Replace(strings.ToLower(FQDN(name)), `\052`, "*", -1)
+}
+
+// sameRecord reports whether two records with the same key hold the same
+// data. The order of their values is not significant.
+func sameRecord(a, b ResourceRecordSet) bool {
+	if a.TTL != b.TTL || !sameWeight(a.Weight, b.Weight) || a.HealthCheckId != b.HealthCheckId ||
+		a.Region != b.Region || a.Failover != b.Failover {
+		return false
+	}
+	if (a.AliasTarget == nil) != (b.AliasTarget == nil) {
+		return false
+	}
+	if a.AliasTarget != nil && !sameAliasTarget(*a.AliasTarget, *b.AliasTarget) {
+		return false
+	}
+	return sameValues(a.Values(), b.Values())
+}
+
+// sameAliasTarget reports whether two alias targets point at the same name,
+// however its case and trailing dot are written.
+func sameAliasTarget(a, b AliasTarget) bool {
+	return a.HostedZoneId == b.HostedZoneId && a.EvaluateTargetHealth == b.EvaluateTargetHealth &&
+		normalizeName(a.DNSName) == normalizeName(b.DNSName)
+}
+
+// sameWeight reports whether two weights are both unset or both set to the
+// same value.
+func sameWeight(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// sameValues reports whether a and b hold the same values in any order.
+func sameValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func FQDN(name string) string {
 	n := len(name)
 	if n == 0 || name[n-1] == '.' {
@@ -0,0 +1,197 @@
+package route53_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cloudops/cloudops-goamz/aws"
+	"github.com/pivotal-cloudops/cloudops-goamz/elb"
+	"github.com/pivotal-cloudops/cloudops-goamz/elb/elbtest"
+	"github.com/pivotal-cloudops/cloudops-goamz/route53"
+	"github.com/pivotal-cloudops/cloudops-goamz/route53/route53test"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct {
+	srv    *route53test.Server
+	r53    *route53.Route53
+	zoneId string
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpTest(c *C) {
+	srv, err := route53test.NewServer()
+	c.Assert(err, IsNil)
+	s.srv = srv
+	s.r53 = route53.New(aws.Auth{AccessKey: "key", SecretKey: "secret"}, aws.Region{Route53Endpoint: srv.URL()})
+	resp, err := s.r53.CreateHostedZone(&route53.CreateHostedZoneRequest{Name: "example.com.", CallerReference: "test"})
+	c.Assert(err, IsNil)
+	s.zoneId = resp.HostedZone.ID
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.srv.Quit()
+}
+
+func record(name, typ string, values ...string) route53.ResourceRecordSet {
+	r := route53.ResourceRecordSet{Name: name, Type: typ, TTL: 300}
+	r.SetValues(values...)
+	return r
+}
+
+func (s *S) TestReconcile(c *C) {
+	s.srv.SetPendingPolls(0)
+	s.srv.AddRecords(record("old.example.com.", "A", "10.0.0.1"), record("www.example.com.", "A", "10.0.0.1"))
+	desired := []route53.ResourceRecordSet{
+		record("www.example.com.", "A", "10.0.0.2"),
+		record("new.example.com.", "CNAME", "www.example.com."),
+	}
+	_, err := s.r53.Reconcile(s.zoneId, desired)
+	c.Assert(err, IsNil)
+	c.Assert(s.srv.ChangeBatches(), HasLen, 1)
+	c.Assert(s.srv.ChangeBatches()[0].Changes, DeepEquals, []route53test.AppliedChange{
+		{Action: "UPSERT", Name: "www.example.com.", Type: "A"},
+		{Action: "CREATE", Name: "new.example.com.", Type: "CNAME"},
+		{Action: "DELETE", Name: "old.example.com.", Type: "A"},
+	})
+	_, err = s.r53.Reconcile(s.zoneId, desired)
+	c.Assert(err, Equals, route53.ErrNoChanges)
+}
+
+func (s *S) TestReconcileNormalizesNames(c *C) {
+	desired := []route53.ResourceRecordSet{
+		record("WWW.example.com", "A", "10.0.0.1"),
+		record("*.example.com.", "A", "10.0.0.1"),
+		{
+			Name: "lb.example.com.",
+			Type: "A",
+			AliasTarget: &route53.AliasTarget{
+				HostedZoneId: "Z3DZXE0Q79N41H",
+				DNSName:      "My-LB.us-east-1.elb.amazonaws.com",
+			},
+		},
+	}
+	_, err := s.r53.Reconcile(s.zoneId, desired)
+	c.Assert(err, IsNil)
+	_, err = s.r53.Reconcile(s.zoneId, desired)
+	c.Assert(err, Equals, route53.ErrNoChanges)
+}
+
+func (s *S) TestListResourceRecordSetsPages(c *C) {
+	s.srv.AddRecords(record("a.example.com.", "A", "10.0.0.1"), record("b.example.com.", "A", "10.0.0.2"))
+	resp, err := s.r53.ListResourceRecordSets(s.zoneId, &route53.ListOpts{MaxItems: 3})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Records, HasLen, 3)
+	c.Assert(resp.IsTruncated, Equals, true)
+	c.Assert(resp.NextRecordName, Equals, "b.example.com.")
+	resp, err = s.r53.ListResourceRecordSets(s.zoneId, &route53.ListOpts{
+		Name:     resp.NextRecordName,
+		Type:     resp.NextRecordType,
+		MaxItems: 3,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Records, HasLen, 1)
+	c.Assert(resp.IsTruncated, Equals, false)
+}
+
+func (s *S) TestWaitForChange(c *C) {
+	s.srv.SetPendingPolls(2)
+	resp, err := s.r53.ChangeResourceRecordSets(s.zoneId, &route53.ChangeResourceRecordSetsRequest{
+		Changes: []route53.Change{{Action: "CREATE", Record: record("www.example.com.", "A", "10.0.0.1")}},
+	})
+	c.Assert(err, IsNil)
+	err = s.r53.WaitForChange(resp.ChangeInfo.ID, route53.WaitOptions{Delay: time.Millisecond})
+	c.Assert(err, IsNil)
+	c.Assert(s.srv.Operations()[2:], DeepEquals, []string{"GetChange", "GetChange", "GetChange"})
+}
+
+func (s *S) TestWaitForChangeTimeout(c *C) {
+	s.srv.SetPendingPolls(-1)
+	resp, err := s.r53.ChangeResourceRecordSets(s.zoneId, &route53.ChangeResourceRecordSetsRequest{
+		Changes: []route53.Change{{Action: "CREATE", Record: record("www.example.com.", "A", "10.0.0.1")}},
+	})
+	c.Assert(err, IsNil)
+	err = s.r53.WaitForChange(resp.ChangeInfo.ID, route53.WaitOptions{
+		Delay:    time.Millisecond,
+		MaxDelay: 5 * time.Millisecond,
+		Timeout:  50 * time.Millisecond,
+	})
+	waitErr, ok := err.(*route53.WaitError)
+	c.Assert(ok, Equals, true)
+	c.Assert(waitErr.Status, Equals, "PENDING")
+	c.Assert(waitErr.Err, Equals, context.DeadlineExceeded)
+}
+
+func (s *S) TestChangeWithRetry(c *C) {
+	s.r53.ChangeRetryDelay = 10 * time.Millisecond
+	var logged []string
+	s.r53.ChangeLogger = func(change route53.Change) {
+		logged = append(logged, change.Action+" "+change.Record.Name)
+	}
+	s.srv.SetSerializeChanges(true)
+	_, err := s.r53.ChangeWithRetry(s.zoneId, []route53.Change{{Action: "CREATE", Record: record("a.example.com.", "A", "10.0.0.1")}})
+	c.Assert(err, IsNil)
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		s.srv.AdvanceAllChanges()
+	}()
+	_, err = s.r53.ChangeWithRetry(s.zoneId, []route53.Change{{Action: "CREATE", Record: record("b.example.com.", "A", "10.0.0.1")}})
+	c.Assert(err, IsNil)
+	c.Assert(s.srv.ChangeBatches(), HasLen, 2)
+	c.Assert(logged, DeepEquals, []string{"CREATE a.example.com.", "CREATE b.example.com."})
+}
+
+func (s *S) TestErrorPredicates(c *C) {
+	_, err := s.r53.ListResourceRecordSets("Z999", nil)
+	e, ok := route53.AsError(err)
+	c.Assert(ok, Equals, true)
+	c.Assert(e.IsNotFound(), Equals, true)
+
+	_, err = s.r53.ChangeResourceRecordSets(s.zoneId, &route53.ChangeResourceRecordSetsRequest{
+		Changes: []route53.Change{{Action: "DELETE", Record: record("none.example.com.", "A", "10.0.0.1")}},
+	})
+	e, ok = route53.AsError(fmt.Errorf("deleting: %w", err))
+	c.Assert(ok, Equals, true)
+	c.Assert(e.IsInvalidChangeBatch(), Equals, true)
+
+	s.srv.SetSerializeChanges(true)
+	for i := 0; i < 2; i++ {
+		_, err = s.r53.ChangeResourceRecordSets(s.zoneId, &route53.ChangeResourceRecordSetsRequest{
+			Changes: []route53.Change{{Action: "UPSERT", Record: record("www.example.com.", "A", "10.0.0.1")}},
+		})
+	}
+	e, ok = route53.AsError(err)
+	c.Assert(ok, Equals, true)
+	c.Assert(e.IsThrottling(), Equals, true)
+}
+
+func (s *S) TestUpsertAliasForLB(c *C) {
+	elbSrv, err := elbtest.NewServer()
+	c.Assert(err, IsNil)
+	defer elbSrv.Quit()
+	elbSrv.NewLoadBalancer("testlb")
+	lbs, err := elb.New(aws.Auth{AccessKey: "key", SecretKey: "secret"}, aws.Region{ELBEndpoint: elbSrv.URL()}).
+		DescribeLoadBalancers(&elb.DescribeLoadBalancer{})
+	c.Assert(err, IsNil)
+	lb := lbs.LoadBalancers[0]
+
+	for i := 0; i < 2; i++ {
+		_, err = s.r53.UpsertAliasForLB(s.zoneId, "WWW.example.com", lb)
+		c.Assert(err, IsNil)
+	}
+	r, ok := s.srv.AssertRecord("www.example.com.", "A")
+	c.Assert(ok, Equals, true)
+	c.Assert(r.AliasTarget.HostedZoneId, Equals, lb.HostedZoneNameID)
+	c.Assert(r.AliasTarget.DNSName, Equals, route53.FQDN(lb.DNSName))
+	c.Assert(s.srv.Records(), HasLen, 1)
+
+	_, err = s.r53.UpsertAliasForLB(s.zoneId, "www.example.org", lb)
+	c.Assert(err, ErrorMatches, "record www.example.org is not within hosted zone example.com.")
+}
@@ -4,10 +4,19 @@
 package route53test
 
 import (
+	"bytes"
+	"crypto/x509"
 	"encoding/xml"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,26 +32,173 @@ type action struct {
 }
 
 type Server struct {
-	reqId    int
-	url      string
-	listener net.Listener
-	mutex    sync.Mutex
-	records  []route53.ResourceRecordSet
+	reqId        int
+	url          string
+	listener     net.Listener
+	certPool     *x509.CertPool
+	ready        chan struct{}
+	options      ServerOptions
+	mutex        sync.Mutex
+	records      map[string][]route53.ResourceRecordSet
+	zones        []route53.HostedZone
+	zoneId       int
+	zoneRecords  map[string][]route53.ResourceRecordSet
+	defaultZone  string
+	checks       []route53.HealthCheck
+	batches      []ChangeBatch
+	changes      map[string]*change
+	lastChanges  map[string]string
+	callerRefs   map[string]callerRefChange
+	serialize    bool
+	pendingPolls int
+	rawResponses map[string]rawResponse
+	operations   []string
+	onRequest    func(*http.Request)
+	authError    *Error
+	logf         func(format string, args ...interface{})
 }
 
+// A change tracks the status of a submitted change batch. The first
+// pendingPolls GetChange calls report a change as PENDING, later ones as
+// INSYNC.
+type change struct {
+	info  route53.ChangeInfo
+	polls int
+}
+
+// CallerReferenceHeader is a header tests can set on a
+// ChangeResourceRecordSets request to give the batch a caller reference. A
+// batch resubmitted with the same caller reference is applied only once.
+// Route53 itself has no such header.
+const CallerReferenceHeader = "X-Caller-Reference"
+
+// A callerRefChange records the change batch submitted with a caller
+// reference, and the change it was applied as.
+type callerRefChange struct {
+	id      string
+	request route53.ChangeResourceRecordSetsRequest
+}
+
+// ServerOptions configures a server started by NewServerWithOptions. NewServer
+// starts a server with the zero value of each field but PendingPolls, which
+// it sets to 1.
+type ServerOptions struct {
+	// PageSize is the number of record sets ListResourceRecordSets returns
+	// per page when the request doesn't give a valid maxitems. It defaults
+	// to, and is capped at, 100.
+	PageSize int
+	// PendingPolls is the number of GetChange calls reporting a change as
+	// PENDING, as set by SetPendingPolls. With 0, a change is INSYNC when
+	// first polled.
+	PendingPolls int
+	// SerializeChanges is set as by SetSerializeChanges. It defaults to
+	// false.
+	SerializeChanges bool
+	// Logger logs unknown actions and server errors, as set by SetLogger. By
+	// default they are discarded.
+	Logger func(format string, args ...interface{})
+	// TLS makes the server serve HTTPS, as NewTLSServer does. It defaults to
+	// false.
+	TLS bool
+}
+
+// defaultOptions are the options of a server started by NewServer.
+var defaultOptions = ServerOptions{PendingPolls: 1}
+
+// NewServer returns a new server with the default options.
 func NewServer() (*Server, error) {
+	return NewServerWithOptions(defaultOptions)
+}
+
+// NewServerWithOptions returns a new server configured by opts. Reset
+// returns the server to that configuration.
+func NewServerWithOptions(opts ServerOptions) (*Server, error) {
+	if opts.TLS {
+		return newTLSServer(opts), nil
+	}
 	l, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		return nil, fmt.Errorf("cannot listen on localhost: %v", err)
 	}
-	srv := &Server{
-		listener: l,
-		url:      "http://" + l.Addr().String(),
-	}
-	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	return newServerWithListener(l, opts), nil
+}
+
+// NewServerWithListener returns a new server serving on l.
+func NewServerWithListener(l net.Listener) *Server {
+	return newServerWithListener(l, defaultOptions)
+}
+
+func newServerWithListener(l net.Listener, opts ServerOptions) *Server {
+	srv := newServer(opts)
+	srv.listener = l
+	srv.url = "http://" + l.Addr().String()
+	go http.Serve(&readyListener{Listener: l, ready: srv.ready}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		srv.serveHTTP(w, req)
 	}))
-	return srv, nil
+	return srv
+}
+
+// NewTLSServer returns a new server serving HTTPS with a self-signed
+// certificate, which clients can trust through the pool returned by CertPool.
+func NewTLSServer() (*Server, error) {
+	return newTLSServer(defaultOptions), nil
+}
+
+func newTLSServer(opts ServerOptions) *Server {
+	srv := newServer(opts)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		srv.serveHTTP(w, req)
+	}))
+	ts.Listener = &readyListener{Listener: ts.Listener, ready: srv.ready}
+	ts.StartTLS()
+	srv.listener = ts.Listener
+	srv.url = ts.URL
+	srv.certPool = x509.NewCertPool()
+	srv.certPool.AddCert(ts.Certificate())
+	return srv
+}
+
+func newServer(opts ServerOptions) *Server {
+	if opts.PageSize <= 0 || opts.PageSize > maxListItems {
+		opts.PageSize = maxListItems
+	}
+	logf := opts.Logger
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	return &Server{
+		ready:        make(chan struct{}),
+		options:      opts,
+		serialize:    opts.SerializeChanges,
+		records:      make(map[string][]route53.ResourceRecordSet),
+		zoneRecords:  make(map[string][]route53.ResourceRecordSet),
+		changes:      make(map[string]*change),
+		lastChanges:  make(map[string]string),
+		callerRefs:   make(map[string]callerRefChange),
+		pendingPolls: opts.PendingPolls,
+		rawResponses: make(map[string]rawResponse),
+		logf:         logf,
+	}
+}
+
+// Ready returns a channel that is closed once the server is accepting
+// connections. The server also answers GET /ping with 200 OK, without
+// recording an operation or using up a request id.
+func (srv *Server) Ready() <-chan struct{} {
+	return srv.ready
+}
+
+// readyListener closes ready the first time the server accepts a connection
+// from it.
+type readyListener struct {
+	net.Listener
+	once  sync.Once
+	ready chan struct{}
+}
+
+func (l *readyListener) Accept() (net.Conn, error) {
+	l.once.Do(func() { close(l.ready) })
+	return l.Listener.Accept()
 }
 
 func (srv *Server) Quit() error {
@@ -53,6 +209,48 @@ func (srv *Server) URL() string {
 	return srv.url
 }
 
+// CertPool returns a pool trusting the certificate of a server started with
+// NewTLSServer, or nil for other servers.
+func (srv *Server) CertPool() *x509.CertPool {
+	return srv.certPool
+}
+
+// Reset discards the records, hosted zones, health checks, changes and
+// recorded operations of the server, and restarts its request and hosted
+// zone ids, leaving it as newly started with the options it was started
+// with. The logger and OnRequest hook are kept.
+func (srv *Server) Reset() {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.reqId = 0
+	srv.records = make(map[string][]route53.ResourceRecordSet)
+	srv.zones = nil
+	srv.zoneId = 0
+	srv.zoneRecords = make(map[string][]route53.ResourceRecordSet)
+	srv.defaultZone = ""
+	srv.checks = nil
+	srv.batches = nil
+	srv.changes = make(map[string]*change)
+	srv.lastChanges = make(map[string]string)
+	srv.callerRefs = make(map[string]callerRefChange)
+	srv.serialize = srv.options.SerializeChanges
+	srv.pendingPolls = srv.options.PendingPolls
+	srv.rawResponses = make(map[string]rawResponse)
+	srv.authError = nil
+	srv.operations = nil
+}
+
+// SetLogger sets the function used to log unknown actions and server errors.
+// The default, or a nil logf, discards them.
+func (srv *Server) SetLogger(logf func(format string, args ...interface{})) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	srv.logf = logf
+}
+
 type Error struct {
 	StatusCode int
 	Code       string
@@ -63,94 +261,1034 @@ func (e Error) Error() string {
 	return fmt.Sprintf("%d: %s", e.StatusCode, e.Message)
 }
 
-func (srv *Server) handleError(w http.ResponseWriter, err error) {
-	fmt.Println(err.Error())
+// handleError writes err to w as an XML error response. Errors that are not
+// an Error are reported as a 500 rather than crashing the server.
+func (srv *Server) handleError(w http.ResponseWriter, err error, reqId string) {
+	switch e := err.(type) {
+	case *Error:
+		srv.error(w, e, reqId)
+	case Error:
+		srv.error(w, &e, reqId)
+	default:
+		srv.logf("Fake Route53 server error: %v", err)
+		srv.error(w, &Error{
+			StatusCode: 500,
+			Code:       "InternalFailure",
+			Message:    err.Error(),
+		}, reqId)
+	}
+}
+
+func (srv *Server) listResourceRecordSets(w http.ResponseWriter, req *http.Request, reqID string) (interface{}, error) {
+	_, zone, _ := route(req.URL.Path)
+	if _, err := srv.zone(zone); err != nil {
+		return nil, err
+	}
+	records := srv.recordSets(zone)
+	sort.Stable(recordsByName(records))
+	start := route53.ResourceRecordSet{
+		Name:          req.FormValue("name"),
+		Type:          req.FormValue("type"),
+		SetIdentifier: req.FormValue("identifier"),
+	}
+	i := sort.Search(len(records), func(i int) bool { return !recordLess(records[i], start) })
+	resp := route53.ListResourceRecordSetsResponse{
+		Records:  records[i:],
+		MaxItems: maxItems(req, srv.options.PageSize),
+	}
+	if len(resp.Records) > resp.MaxItems {
+		next := resp.Records[resp.MaxItems]
+		resp.Records = resp.Records[:resp.MaxItems]
+		resp.IsTruncated = true
+		resp.NextRecordName = next.Name
+		resp.NextRecordType = next.Type
+		resp.NextRecordIdentifier = next.SetIdentifier
+	}
+	return resp, nil
+}
+
+// maxListItems is both the default and the largest number of items in a
+// page of a listing.
+const maxListItems = 100
 
-	if err, ok := err.(Error); ok {
-		w.WriteHeader(err.StatusCode)
-		w.Write([]byte(err.Message))
-	} else {
-		w.WriteHeader(500)
-		panic("Server error: " + err.Error())
+// maxItems returns the number of items asked for by the maxitems parameter
+// of req. As on AWS, it falls back to def when maxitems isn't a positive
+// number, and is clamped to maxListItems.
+func maxItems(req *http.Request, def int) int {
+	n, err := strconv.Atoi(req.FormValue("maxitems"))
+	switch {
+	case err != nil || n <= 0:
+		return def
+	case n > maxListItems:
+		return maxListItems
 	}
+	return n
+}
 
+// recordsByName sorts record sets in the order Route53 lists them: by name,
+// compared label by label from the root, then by type, then by set
+// identifier.
+type recordsByName []route53.ResourceRecordSet
+
+func (r recordsByName) Len() int           { return len(r) }
+func (r recordsByName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r recordsByName) Less(i, j int) bool { return recordLess(r[i], r[j]) }
+
+func recordLess(a, b route53.ResourceRecordSet) bool {
+	if an, bn := reversedName(a.Name), reversedName(b.Name); an != bn {
+		return an < bn
+	}
+	if a.Type != b.Type {
+		return a.Type < b.Type
+	}
+	return a.SetIdentifier < b.SetIdentifier
 }
 
-func (srv *Server) listResourceRecordSets(w http.ResponseWriter, req *http.Request, reqID string) (interface{}, error) {
-	return route53.ListResourceRecordSetsResponse{
-		Records: srv.records,
-	}, nil
+// reversedName returns the labels of a domain name from the root down, so
+// that names sort next to their parents: a.example.com becomes com.example.a.
+func reversedName(name string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".")
+}
+
+// recordSets returns the record sets listed for a zone: the NS and SOA
+// records created with the zone, followed by the records held in the zone.
+func (srv *Server) recordSets(zoneID string) []route53.ResourceRecordSet {
+	id := route53.CleanZoneID(zoneID)
+	records := append([]route53.ResourceRecordSet(nil), srv.zoneRecords[id]...)
+	return append(records, srv.records[id]...)
+}
+
+// isZoneRecord reports whether record is the NS or SOA record created with a
+// zone, which can't be deleted.
+func (srv *Server) isZoneRecord(zoneID string, record route53.ResourceRecordSet) bool {
+	for _, r := range srv.zoneRecords[route53.CleanZoneID(zoneID)] {
+		if r.Name == record.Name && r.Type == record.Type {
+			return true
+		}
+	}
+	return false
 }
 
 func (srv *Server) changeResourceRecordSets(w http.ResponseWriter, req *http.Request, reqID string) (interface{}, error) {
 	var changeRequest route53.ChangeResourceRecordSetsRequest
 	if err := xml.NewDecoder(req.Body).Decode(&changeRequest); err != nil {
+		return nil, &Error{
+			StatusCode: 400,
+			Code:       "InvalidInput",
+			Message:    fmt.Sprintf("Invalid XML: %v", err),
+		}
+	}
+	if len(changeRequest.Changes) == 0 {
+		return nil, &Error{
+			StatusCode: 400,
+			Code:       "InvalidInput",
+			Message:    "The change batch must contain at least one change.",
+		}
+	}
+	_, zone, _ := route(req.URL.Path)
+	if _, err := srv.zone(zone); err != nil {
 		return nil, err
 	}
+	// Caller references are kept per zone, so the same one may be used with
+	// several zones.
+	callerRef := req.Header.Get(CallerReferenceHeader)
+	refKey := route53.CleanZoneID(zone) + " " + callerRef
+	if prior, ok := srv.callerRefs[refKey]; ok && callerRef != "" {
+		if !reflect.DeepEqual(prior.request, changeRequest) {
+			return nil, &Error{
+				StatusCode: 400,
+				Code:       "InvalidInput",
+				Message:    fmt.Sprintf("The caller reference %s was already used for a different change batch.", callerRef),
+			}
+		}
+		return route53.ChangeResourceRecordSetsResponse{ChangeInfo: srv.changes[route53.CleanChangeID(prior.id)].info}, nil
+	}
+	if last, ok := srv.changes[route53.CleanChangeID(srv.lastChanges[zone])]; ok && srv.serialize && last.info.Status == "PENDING" {
+		return nil, &Error{
+			StatusCode: 400,
+			Code:       "PriorRequestNotComplete",
+			Message:    "The request was rejected because Route 53 was still processing a prior request.",
+		}
+	}
+	// Changes are applied to copies of the records of the zone, so that a
+	// batch with an invalid change leaves them untouched.
+	records := append([]route53.ResourceRecordSet(nil), srv.records[route53.CleanZoneID(zone)]...)
+	zoneRecords := append([]route53.ResourceRecordSet(nil), srv.zoneRecords[route53.CleanZoneID(zone)]...)
+	batch := ChangeBatch{Comment: changeRequest.Comment}
 	for _, change := range changeRequest.Changes {
+		record := normalizeRecord(change.Record)
 		switch change.Action {
 		case "CREATE":
-			srv.records = append(srv.records, change.Record)
+			if err := validateRecord(record); err != nil {
+				return nil, err
+			}
+			if hasRecord(records, record) || hasRecord(zoneRecords, record) {
+				return nil, &Error{
+					StatusCode: 400,
+					Code:       "InvalidChangeBatch",
+					Message:    fmt.Sprintf("Tried to create resource record set [name='%s', type='%s'] but it already exists", record.Name, record.Type),
+				}
+			}
+			records = append(records, record)
+		case "UPSERT":
+			if err := validateRecord(record); err != nil {
+				return nil, err
+			}
+			if hasRecord(zoneRecords, record) {
+				zoneRecords = upsertRecord(zoneRecords, record)
+			} else {
+				records = upsertRecord(records, record)
+			}
 		case "DELETE":
-			for i, record := range srv.records {
-				if record.Name == change.Record.Name {
-					srv.records = append(srv.records[:i], srv.records[i+1:]...)
+			if srv.isZoneRecord(zone, record) {
+				return nil, &Error{
+					StatusCode: 400,
+					Code:       "InvalidChangeBatch",
+					Message:    fmt.Sprintf("Tried to delete resource record set [name='%s', type='%s'] but the %s record of a hosted zone can't be deleted", record.Name, record.Type, record.Type),
 				}
 			}
+			var err error
+			if records, err = deleteRecord(records, record); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, &Error{
+				StatusCode: 400,
+				Code:       "InvalidInput",
+				Message:    fmt.Sprintf("Invalid change action: %s", change.Action),
+			}
 		}
+		batch.Changes = append(batch.Changes, AppliedChange{
+			Action: change.Action,
+			Name:   record.Name,
+			Type:   record.Type,
+		})
 	}
-	return route53.ChangeResourceRecordSetsResponse{
-		ChangeInfo: route53.ChangeInfo{
-			ID:          "some-id",
-			Status:      "some-status",
-			SubmittedAt: time.Now().Format("2006-01-02T15:04:05Z"),
-		},
+	srv.records[route53.CleanZoneID(zone)] = records
+	srv.zoneRecords[route53.CleanZoneID(zone)] = zoneRecords
+	srv.batches = append(srv.batches, batch)
+	info := srv.newChange(changeRequest.Comment)
+	if callerRef != "" {
+		srv.callerRefs[refKey] = callerRefChange{id: info.ID, request: changeRequest}
+	}
+	srv.lastChanges[zone] = info.ID
+	return route53.ChangeResourceRecordSetsResponse{ChangeInfo: info}, nil
+}
+
+// newChange records a new PENDING change. As on Route53, the id of the
+// change is returned prefixed with /change/, while changes are kept by their
+// bare id.
+func (srv *Server) newChange(comment string) route53.ChangeInfo {
+	info := route53.ChangeInfo{
+		ID:          fmt.Sprintf("/change/C%012d", len(srv.changes)+1),
+		Status:      "PENDING",
+		SubmittedAt: time.Now().Format("2006-01-02T15:04:05Z"),
+		Comment:     comment,
+	}
+	srv.changes[route53.CleanChangeID(info.ID)] = &change{info: info}
+	return info
+}
+
+func (srv *Server) getChange(w http.ResponseWriter, req *http.Request, reqID string) (interface{}, error) {
+	_, id, _ := route(req.URL.Path)
+	c, ok := srv.changes[route53.CleanChangeID(id)]
+	if !ok {
+		return nil, &Error{
+			StatusCode: 404,
+			Code:       "NoSuchChange",
+			Message:    fmt.Sprintf("A change with the specified change ID %s does not exist.", id),
+		}
+	}
+	if c.polls++; srv.pendingPolls >= 0 && c.polls > srv.pendingPolls {
+		c.info.Status = "INSYNC"
+	}
+	return route53.GetChangeResponse{ChangeInfo: c.info}, nil
+}
+
+// SetSerializeChanges sets whether a change batch submitted to a zone while
+// the zone's previous change is still PENDING fails with
+// PriorRequestNotComplete, as it does on Route53. It is false by default.
+func (srv *Server) SetSerializeChanges(serialize bool) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.serialize = serialize
+}
+
+// SetAuthError makes every request fail with err before it is dispatched, as
+// AWS rejects requests signed with bad credentials, such as with
+// InvalidClientTokenId or SignatureDoesNotMatch. A nil err clears it.
+func (srv *Server) SetAuthError(err *Error) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.authError = err
+}
+
+// OnRequest sets a function called with every request the server receives,
+// before it is dispatched, so tests can capture or check anything about it.
+// It is called with the server locked, so f must not call the methods of the
+// server, which would deadlock. The body it reads is restored for the
+// handlers. A nil f removes the hook.
+func (srv *Server) OnRequest(f func(*http.Request)) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.onRequest = f
+}
+
+// SetPendingPolls sets how many GetChange calls report a change as PENDING
+// before it becomes INSYNC. It is 1 on a server started by NewServer; a
+// negative n keeps changes PENDING forever.
+func (srv *Server) SetPendingPolls(n int) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.pendingPolls = n
+}
+
+// AdvanceChangeStatus makes the change with the given id INSYNC, whatever
+// the number of times it was polled. Unknown changes are ignored.
+func (srv *Server) AdvanceChangeStatus(changeId string) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if c, ok := srv.changes[route53.CleanChangeID(changeId)]; ok {
+		c.info.Status = "INSYNC"
+	}
+}
+
+// AdvanceAllChanges makes every change submitted so far INSYNC.
+func (srv *Server) AdvanceAllChanges() {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	for _, c := range srv.changes {
+		c.info.Status = "INSYNC"
+	}
+}
+
+// SetRawResponse makes the server answer every request for method on
+// resource with the given status, body and content type instead of handling
+// it, so clients can be tested against malformed responses. Resources are
+// the path elements the server routes on, such as rrset or hostedzone, and
+// collections are listed with the pseudo method LIST. A zero status removes
+// the response.
+func (srv *Server) SetRawResponse(resource, method string, status int, body []byte, contentType string) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	key := resource + " " + method
+	if status == 0 {
+		delete(srv.rawResponses, key)
+		return
+	}
+	srv.rawResponses[key] = rawResponse{status, append([]byte(nil), body...), contentType}
+}
+
+// A rawResponse is written verbatim in place of the response to an action.
+type rawResponse struct {
+	status      int
+	body        []byte
+	contentType string
+}
+
+// write writes the response to w.
+func (r rawResponse) write(w http.ResponseWriter) {
+	if r.contentType != "" {
+		w.Header().Set("Content-Type", r.contentType)
+	}
+	w.WriteHeader(r.status)
+	w.Write(r.body)
+}
+
+// delegationSet holds the name servers of every hosted zone.
+var delegationSet = route53.DelegationSet{
+	NameServers: []string{
+		"ns-1.awsdns-01.com",
+		"ns-2.awsdns-02.net",
+		"ns-3.awsdns-03.org",
+		"ns-4.awsdns-04.co.uk",
+	},
+}
+
+func (srv *Server) createHostedZone(w http.ResponseWriter, req *http.Request, reqID string) (interface{}, error) {
+	var createRequest route53.CreateHostedZoneRequest
+	if err := xml.NewDecoder(req.Body).Decode(&createRequest); err != nil {
+		return nil, &Error{
+			StatusCode: 400,
+			Code:       "InvalidInput",
+			Message:    fmt.Sprintf("Invalid XML: %v", err),
+		}
+	}
+	if createRequest.Name == "" || createRequest.CallerReference == "" {
+		return nil, &Error{
+			StatusCode: 400,
+			Code:       "InvalidInput",
+			Message:    "Name and CallerReference are required.",
+		}
+	}
+	for _, zone := range srv.zones {
+		if zone.CallerReference == createRequest.CallerReference {
+			return nil, &Error{
+				StatusCode: 409,
+				Code:       "HostedZoneAlreadyExists",
+				Message:    fmt.Sprintf("A hosted zone with caller reference %s already exists.", zone.CallerReference),
+			}
+		}
+	}
+	srv.zoneId++
+	zone := route53.HostedZone{
+		ID:              fmt.Sprintf("/hostedzone/Z%012d", srv.zoneId),
+		Name:            route53.FQDN(strings.ToLower(createRequest.Name)),
+		CallerReference: createRequest.CallerReference,
+		Comment:         createRequest.Comment,
+	}
+	srv.zones = append(srv.zones, zone)
+	srv.zoneRecords[route53.CleanZoneID(zone.ID)] = defaultRecords(zone.Name)
+	if srv.defaultZone == "" {
+		// Records seeded before any zone existed move to the first zone.
+		srv.defaultZone = route53.CleanZoneID(zone.ID)
+		srv.records[srv.defaultZone] = srv.records[""]
+		delete(srv.records, "")
+	}
+	return route53.CreateHostedZoneResponse{
+		HostedZone:    srv.withRecordCount(zone),
+		ChangeInfo:    srv.newChange(""),
+		DelegationSet: delegationSet,
+	}, nil
+}
+
+// defaultRecords returns the NS and SOA records Route53 creates with a hosted
+// zone named name.
+func defaultRecords(name string) []route53.ResourceRecordSet {
+	var nameServers []string
+	for _, ns := range delegationSet.NameServers {
+		nameServers = append(nameServers, route53.FQDN(ns))
+	}
+	ns := route53.ResourceRecordSet{Name: name, Type: "NS", TTL: 172800}
+	ns.SetValues(nameServers...)
+	soa := route53.ResourceRecordSet{Name: name, Type: "SOA", TTL: 900}
+	soa.SetValues(nameServers[0] + " awsdns-hostmaster.amazon.com. 1 7200 900 1209600 86400")
+	return []route53.ResourceRecordSet{ns, soa}
+}
+
+// withRecordCount returns zone with its count of record sets filled in.
+func (srv *Server) withRecordCount(zone route53.HostedZone) route53.HostedZone {
+	zone.ResourceCount = len(srv.recordSets(zone.ID))
+	return zone
+}
+
+// zone returns the index in srv.zones of the hosted zone with the given id.
+func (srv *Server) zone(id string) (int, error) {
+	for i, zone := range srv.zones {
+		if route53.CleanZoneID(zone.ID) == route53.CleanZoneID(id) {
+			return i, nil
+		}
+	}
+	return 0, &Error{
+		StatusCode: 404,
+		Code:       "NoSuchHostedZone",
+		Message:    fmt.Sprintf("No hosted zone found with ID: %s", id),
+	}
+}
+
+func (srv *Server) getHostedZone(w http.ResponseWriter, req *http.Request, reqID string) (interface{}, error) {
+	_, id, _ := route(req.URL.Path)
+	i, err := srv.zone(id)
+	if err != nil {
+		return nil, err
+	}
+	return route53.GetHostedZoneResponse{
+		HostedZone:    srv.withRecordCount(srv.zones[i]),
+		DelegationSet: delegationSet,
+	}, nil
+}
+
+func (srv *Server) deleteHostedZone(w http.ResponseWriter, req *http.Request, reqID string) (interface{}, error) {
+	_, id, _ := route(req.URL.Path)
+	i, err := srv.zone(id)
+	if err != nil {
+		return nil, err
+	}
+	delete(srv.zoneRecords, route53.CleanZoneID(srv.zones[i].ID))
+	delete(srv.records, route53.CleanZoneID(srv.zones[i].ID))
+	if srv.defaultZone == route53.CleanZoneID(srv.zones[i].ID) {
+		srv.defaultZone = ""
+	}
+	srv.zones = append(srv.zones[:i:i], srv.zones[i+1:]...)
+	return route53.DeleteHostedZoneResponse{ChangeInfo: srv.newChange("")}, nil
+}
+
+func (srv *Server) listHostedZones(w http.ResponseWriter, req *http.Request, reqID string) (interface{}, error) {
+	zones := []route53.HostedZone{}
+	for _, zone := range srv.zones {
+		zones = append(zones, srv.withRecordCount(zone))
+	}
+	return route53.ListHostedZonesResponse{
+		HostedZones: zones,
+		MaxItems:    len(zones),
+	}, nil
+}
+
+// listHostedZonesByName returns, sorted by name, the hosted zones that could
+// hold the dnsname parameter: those named after it or one of its parents.
+func (srv *Server) listHostedZonesByName(w http.ResponseWriter, req *http.Request, reqID string) (interface{}, error) {
+	dnsName := route53.FQDN(strings.ToLower(req.FormValue("dnsname")))
+	zones := []route53.HostedZone{}
+	for _, zone := range srv.zones {
+		if dnsName == "" || dnsName == zone.Name || strings.HasSuffix(dnsName, "."+zone.Name) {
+			zones = append(zones, srv.withRecordCount(zone))
+		}
+	}
+	sort.Sort(zonesByName(zones))
+	return route53.ListHostedZonesByNameResponse{
+		HostedZones: zones,
+		DNSName:     dnsName,
+		MaxItems:    len(zones),
 	}, nil
 }
 
+type zonesByName []route53.HostedZone
+
+func (z zonesByName) Len() int      { return len(z) }
+func (z zonesByName) Swap(i, j int) { z[i], z[j] = z[j], z[i] }
+func (z zonesByName) Less(i, j int) bool {
+	if z[i].Name != z[j].Name {
+		return z[i].Name < z[j].Name
+	}
+	return z[i].ID < z[j].ID
+}
+
+func (srv *Server) getHostedZoneCount(w http.ResponseWriter, req *http.Request, reqID string) (interface{}, error) {
+	return route53.GetHostedZoneCountResponse{HostedZoneCount: len(srv.zones)}, nil
+}
+
+// healthCheckTypes are the types of health check Route53 supports.
+var healthCheckTypes = map[string]bool{
+	"HTTP":            true,
+	"HTTPS":           true,
+	"HTTP_STR_MATCH":  true,
+	"HTTPS_STR_MATCH": true,
+	"TCP":             true,
+}
+
+func (srv *Server) createHealthCheck(w http.ResponseWriter, req *http.Request, reqID string) (interface{}, error) {
+	var createRequest route53.CreateHealthCheckRequest
+	if err := xml.NewDecoder(req.Body).Decode(&createRequest); err != nil {
+		return nil, &Error{
+			StatusCode: 400,
+			Code:       "InvalidInput",
+			Message:    fmt.Sprintf("Invalid XML: %v", err),
+		}
+	}
+	config := createRequest.HealthCheckConfig
+	if createRequest.CallerReference == "" {
+		return nil, &Error{
+			StatusCode: 400,
+			Code:       "InvalidInput",
+			Message:    "CallerReference is required.",
+		}
+	}
+	if !healthCheckTypes[config.Type] {
+		return nil, &Error{
+			StatusCode: 400,
+			Code:       "InvalidInput",
+			Message:    fmt.Sprintf("Invalid health check type: %s", config.Type),
+		}
+	}
+	if config.RequestInterval == 0 {
+		config.RequestInterval = 30
+	}
+	if config.FailureThreshold == 0 {
+		config.FailureThreshold = 3
+	}
+	for _, check := range srv.checks {
+		if check.CallerReference != createRequest.CallerReference {
+			continue
+		}
+		if check.HealthCheckConfig != config {
+			return nil, &Error{
+				StatusCode: 409,
+				Code:       "HealthCheckAlreadyExists",
+				Message:    fmt.Sprintf("A health check with caller reference %s already exists with a different configuration", check.CallerReference),
+			}
+		}
+		return route53.CreateHealthCheckResponse{HealthCheck: check}, nil
+	}
+	check := route53.HealthCheck{
+		ID:                 fmt.Sprintf("00000000-0000-0000-0000-%012d", len(srv.checks)+1),
+		CallerReference:    createRequest.CallerReference,
+		HealthCheckConfig:  config,
+		HealthCheckVersion: 1,
+	}
+	srv.checks = append(srv.checks, check)
+	return route53.CreateHealthCheckResponse{HealthCheck: check}, nil
+}
+
+func (srv *Server) getHealthCheck(w http.ResponseWriter, req *http.Request, reqID string) (interface{}, error) {
+	_, id, _ := route(req.URL.Path)
+	for _, check := range srv.checks {
+		if check.ID == id {
+			return route53.GetHealthCheckResponse{HealthCheck: check}, nil
+		}
+	}
+	return nil, &Error{
+		StatusCode: 404,
+		Code:       "NoSuchHealthCheck",
+		Message:    fmt.Sprintf("A health check with the specified id %s does not exist.", id),
+	}
+}
+
+// hasRecord reports whether records holds a record set with the name, type
+// and set identifier of record.
+func hasRecord(records []route53.ResourceRecordSet, record route53.ResourceRecordSet) bool {
+	for _, r := range records {
+		if r.Name == record.Name && r.Type == record.Type && r.SetIdentifier == record.SetIdentifier {
+			return true
+		}
+	}
+	return false
+}
+
+// upsertRecord replaces the record in records with the same name, type and
+// set identifier as record, or adds record if there is none.
+func upsertRecord(records []route53.ResourceRecordSet, record route53.ResourceRecordSet) []route53.ResourceRecordSet {
+	for i, r := range records {
+		if r.Name == record.Name && r.Type == record.Type && r.SetIdentifier == record.SetIdentifier {
+			records[i] = record
+			return records
+		}
+	}
+	return append(records, record)
+}
+
+// deleteRecord removes record from records. As on Route53, the record must
+// match the stored one exactly, though its values may be listed in any order.
+func deleteRecord(records []route53.ResourceRecordSet, record route53.ResourceRecordSet) ([]route53.ResourceRecordSet, error) {
+	for i, r := range records {
+		if r.Name != record.Name || r.Type != record.Type || r.SetIdentifier != record.SetIdentifier {
+			continue
+		}
+		if r.TTL != record.TTL || !reflect.DeepEqual(r.Weight, record.Weight) || !reflect.DeepEqual(r.AliasTarget, record.AliasTarget) || !sameValues(r.Values(), record.Values()) {
+			return nil, &Error{
+				StatusCode: 400,
+				Code:       "InvalidChangeBatch",
+				Message:    fmt.Sprintf("Tried to delete resource record set [name='%s', type='%s'] but the values provided do not match the current values", record.Name, record.Type),
+			}
+		}
+		return append(records[:i:i], records[i+1:]...), nil
+	}
+	return nil, &Error{
+		StatusCode: 400,
+		Code:       "InvalidChangeBatch",
+		Message:    fmt.Sprintf("Tried to delete resource record set [name='%s', type='%s'] but it was not found", record.Name, record.Type),
+	}
+}
+
+// sameValues reports whether a and b hold the same values in any order, as
+// the order of the values of a record set is not significant.
+func sameValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeRecord rewrites the RecordsXML of record to hold only its resource
+// records. A decoded record's RecordsXML holds all of its inner XML, which
+// would otherwise be repeated when the record is encoded again. As on
+// Route53, the name is made fully qualified and lower case, with the asterisk
+// of a wildcard escaped as \052, and so is the DNS name of an alias target.
+func normalizeRecord(record route53.ResourceRecordSet) route53.ResourceRecordSet {
+	record.Name = strings.Replace(strings.ToLower(route53.FQDN(record.Name)), "*", `\052`, -1)
+	if record.AliasTarget != nil {
+		target := *record.AliasTarget
+		target.DNSName = strings.ToLower(route53.FQDN(target.DNSName))
+		record.AliasTarget = &target
+	}
+	record.SetValues(record.Values()...)
+	return record
+}
+
+// validateRecord checks record is acceptable for a CREATE or UPSERT.
+func validateRecord(record route53.ResourceRecordSet) error {
+	if record.TTL < 0 || int64(record.TTL) > math.MaxInt32 {
+		return &Error{
+			StatusCode: 400,
+			Code:       "InvalidChangeBatch",
+			Message:    fmt.Sprintf("Invalid TTL %d for %s: TTL must be between 0 and %d", record.TTL, record.Name, math.MaxInt32),
+		}
+	}
+	if record.AliasTarget == nil && len(record.Values()) == 0 {
+		return &Error{
+			StatusCode: 400,
+			Code:       "InvalidChangeBatch",
+			Message:    fmt.Sprintf("Invalid request: Expected exactly one of [AliasTarget, all of [TTL, and ResourceRecords]] for %s", record.Name),
+		}
+	}
+	return nil
+}
+
+// Records returns a copy of the records held by the server: those seeded
+// while there is no default zone, followed by the records of each hosted zone
+// in the order the zones were created. The NS and SOA records created with a
+// zone are left out.
+func (srv *Server) Records() []route53.ResourceRecordSet {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return copyRecords(srv.allRecords())
+}
+
+func (srv *Server) allRecords() []route53.ResourceRecordSet {
+	records := srv.records[""]
+	for _, zone := range srv.zones {
+		records = append(records[:len(records):len(records)], srv.records[route53.CleanZoneID(zone.ID)]...)
+	}
+	return records
+}
+
+// ZoneRecords returns a copy of the records held in the hosted zone with the
+// given id, leaving out the NS and SOA records created with the zone.
+func (srv *Server) ZoneRecords(zoneID string) []route53.ResourceRecordSet {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return copyRecords(srv.records[route53.CleanZoneID(zoneID)])
+}
+
+// SetRecords replaces the records of the default zone with a copy of
+// records. The default zone is the first hosted zone created, or, once it is
+// deleted, the next one; records seeded while there is none move to it when
+// it is created. Use AddZoneRecords to seed any other zone.
+func (srv *Server) SetRecords(records []route53.ResourceRecordSet) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.records[srv.defaultZone] = nil
+	for _, record := range copyRecords(records) {
+		srv.records[srv.defaultZone] = append(srv.records[srv.defaultZone], normalizeRecord(record))
+	}
+}
+
+// AddRecords adds a copy of records to the default zone, as described for
+// SetRecords.
+func (srv *Server) AddRecords(records ...route53.ResourceRecordSet) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	for _, record := range copyRecords(records) {
+		srv.records[srv.defaultZone] = append(srv.records[srv.defaultZone], normalizeRecord(record))
+	}
+}
+
+// AddZoneRecords adds a copy of records to the hosted zone with the given id.
+func (srv *Server) AddZoneRecords(zoneID string, records ...route53.ResourceRecordSet) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	id := route53.CleanZoneID(zoneID)
+	for _, record := range copyRecords(records) {
+		srv.records[id] = append(srv.records[id], normalizeRecord(record))
+	}
+}
+
+// AssertRecord returns a copy of the first record held by the server with the
+// given name and type, and whether there is one. The name is compared as
+// records are stored, so its case and a missing trailing dot are ignored.
+func (srv *Server) AssertRecord(name, typ string) (route53.ResourceRecordSet, bool) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	name = normalizeRecord(route53.ResourceRecordSet{Name: name}).Name
+	for _, record := range srv.allRecords() {
+		if record.Name == name && record.Type == typ {
+			return copyRecords([]route53.ResourceRecordSet{record})[0], true
+		}
+	}
+	return route53.ResourceRecordSet{}, false
+}
+
+// copyRecords returns a deep copy of records.
+func copyRecords(records []route53.ResourceRecordSet) []route53.ResourceRecordSet {
+	if records == nil {
+		return nil
+	}
+	copied := make([]route53.ResourceRecordSet, len(records))
+	for i, record := range records {
+		if record.AliasTarget != nil {
+			target := *record.AliasTarget
+			record.AliasTarget = &target
+		}
+		if record.Weight != nil {
+			weight := *record.Weight
+			record.Weight = &weight
+		}
+		copied[i] = record
+	}
+	return copied
+}
+
+// A ChangeBatch is a batch of changes applied by ChangeResourceRecordSets.
+type ChangeBatch struct {
+	Comment string
+	Changes []AppliedChange
+}
+
+// An AppliedChange is a single change of a ChangeBatch.
+type AppliedChange struct {
+	Action string
+	Name   string
+	Type   string
+}
+
+// ChangeBatches returns the change batches applied by the server, in the
+// order they were applied.
+func (srv *Server) ChangeBatches() []ChangeBatch {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	batches := make([]ChangeBatch, len(srv.batches))
+	for i, batch := range srv.batches {
+		batches[i] = ChangeBatch{
+			Comment: batch.Comment,
+			Changes: append([]AppliedChange(nil), batch.Changes...),
+		}
+	}
+	return batches
+}
+
+// xmlErrors is an error response as AWS writes it.
 type xmlErrors struct {
-	XMLName string `xml:"ErrorResponse"`
-	Error   Error
+	XMLName   xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ErrorResponse"`
+	Error     xmlError `xml:"Error"`
+	RequestId string   `xml:"RequestId"`
+}
+
+type xmlError struct {
+	Type    string `xml:"Type"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
 }
 
-func (srv *Server) error(w http.ResponseWriter, err *Error) {
+// errorType tells whether an error with the given HTTP status was caused by
+// the Sender of the request or by the Receiver.
+func errorType(statusCode int) string {
+	if statusCode >= 500 {
+		return "Receiver"
+	}
+	return "Sender"
+}
+
+// Operations returns a copy of the names of the API operations the server has
+// been asked to carry out, in the order they were accepted, even when served
+// concurrently.
+func (srv *Server) Operations() []string {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return append([]string(nil), srv.operations...)
+}
+
+// AssertOperations returns an error describing the first difference between
+// the operations the server has carried out and expected, if any.
+func (srv *Server) AssertOperations(expected []string) error {
+	got := srv.Operations()
+	for i := 0; i < len(got) || i < len(expected); i++ {
+		switch {
+		case i >= len(got):
+			return fmt.Errorf("missing operations %v, got %v", expected[i:], got)
+		case i >= len(expected):
+			return fmt.Errorf("unexpected operations %v, got %v", got[i:], got)
+		case got[i] != expected[i]:
+			return fmt.Errorf("operation %d is %s, expected %s, got %v", i, got[i], expected[i], got)
+		}
+	}
+	return nil
+}
+
+func (srv *Server) error(w http.ResponseWriter, err *Error, reqId string) {
 	w.WriteHeader(err.StatusCode)
-	xmlErr := xmlErrors{Error: *err}
+	xmlErr := xmlErrors{
+		Error: xmlError{
+			Type:    errorType(err.StatusCode),
+			Code:    err.Code,
+			Message: err.Message,
+		},
+		RequestId: reqId,
+	}
 	if e := xml.NewEncoder(w).Encode(xmlErr); e != nil {
-		panic(e)
+		srv.logf("Fake Route53 server failed to encode error %v: %v", err, e)
 	}
 }
 
+// requestId formats the nth request id. Ids are zero padded so that later
+// ids sort after earlier ones.
+func requestId(n int) string {
+	return fmt.Sprintf("req%08X", n)
+}
+
+// RequestIdHeader is the HTTP header in which the server echoes the id of
+// every request it answers, as AWS does.
+const RequestIdHeader = "X-Amzn-RequestId"
+
+// LastRequestId returns the id of the last request the server received, or
+// "" if it hasn't received any.
+func (srv *Server) LastRequestId() string {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.reqId == 0 {
+		return ""
+	}
+	return requestId(srv.reqId - 1)
+}
+
 func (srv *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
-	req.ParseForm()
+	if req.Method == "GET" && req.URL.Path == "/ping" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 	srv.mutex.Lock()
 	defer srv.mutex.Unlock()
+	reqId := requestId(srv.reqId)
+	srv.reqId++
+	w.Header().Set(RequestIdHeader, reqId)
+	if err := checkContentType(req); err != nil {
+		srv.error(w, err, reqId)
+		srv.logf("Fake Route53 server can't parse request: %s", err.Message)
+		return
+	}
+	req.ParseForm()
+	if srv.onRequest != nil {
+		if err := srv.callOnRequest(req); err != nil {
+			srv.handleError(w, err, reqId)
+			return
+		}
+	}
+	if srv.authError != nil {
+		srv.error(w, srv.authError, reqId)
+		return
+	}
 	method := req.Method
-	resource := strings.Split(req.URL.Path, "/")[4]
+	resource, id, err := route(req.URL.Path)
+	if err != nil {
+		srv.error(w, err, reqId)
+		srv.logf("Fake Route53 server can't route: %s %s", method, req.URL.Path)
+		return
+	}
+	// Collections are listed by GETting them without an id, which is told
+	// apart from GETting one of their items as the pseudo method LIST.
+	if method == "GET" && id == "" {
+		method = "LIST"
+	}
 	f := actions[resource][method]
 	if f == nil {
 		srv.error(w, &Error{
 			StatusCode: 400,
 			Code:       "InvalidParameterValue",
 			Message:    "Unrecognized Action",
-		})
-		fmt.Printf("Fake Route53 server doesn't know how to: %s %s\n", method, resource)
+		}, reqId)
+		srv.logf("Fake Route53 server doesn't know how to: %s %s", method, resource)
+		return
+	}
+	srv.operations = append(srv.operations, operations[resource][method])
+	if raw, ok := srv.rawResponses[resource+" "+method]; ok {
+		raw.write(w)
 		return
 	}
-	reqId := fmt.Sprintf("req%0X", srv.reqId)
-	srv.reqId++
 	if resp, err := f(srv, w, req, reqId); err == nil {
-		if err := xml.NewEncoder(w).Encode(resp); err != nil {
-			panic(err)
+		var body bytes.Buffer
+		if err := xml.NewEncoder(&body).Encode(resp); err != nil {
+			srv.logf("Fake Route53 server failed to encode %s %s response: %v", method, resource, err)
+			srv.handleError(w, err, reqId)
+			return
 		}
+		body.WriteTo(w)
 	} else {
-		switch err.(type) {
-		case *Error:
-			srv.error(w, err.(*Error))
-		default:
-			panic(err)
+		srv.handleError(w, err, reqId)
+	}
+}
+
+// callOnRequest calls the OnRequest hook with req, restoring the body of req
+// afterwards whatever the hook read of it.
+func (srv *Server) callOnRequest(req *http.Request) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	srv.onRequest(req)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// checkContentType rejects request bodies that aren't XML, which the server
+// would otherwise fail to decode.
+func checkContentType(req *http.Request) *Error {
+	ct := req.Header.Get("Content-Type")
+	if ct == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err == nil && (mediaType == "application/xml" || mediaType == "text/xml") {
+		return nil
+	}
+	return &Error{
+		StatusCode: 415,
+		Code:       "UnsupportedMediaType",
+		Message:    fmt.Sprintf("Unsupported content type: %s", ct),
+	}
+}
+
+// route returns the resource addressed by path, and the id of the hosted
+// zone, change, etc. it belongs to, if any. Paths have one of the shapes
+//
+//	/2013-04-01/{resource}
+//	/2013-04-01/{resource}/{id}
+//	/2013-04-01/hostedzone/{id}/{resource}
+func route(path string) (resource, id string, err *Error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) >= 2 && parts[0] == route53.APIVersion {
+		switch {
+		case len(parts) == 2:
+			return parts[1], "", nil
+		case len(parts) == 3:
+			return parts[1], parts[2], nil
+		case len(parts) == 4 && parts[1] == "hostedzone":
+			return parts[3], parts[2], nil
 		}
 	}
+	return "", "", &Error{
+		StatusCode: 400,
+		Code:       "InvalidInput",
+		Message:    fmt.Sprintf("Invalid resource path: %s", path),
+	}
+}
+
+// operations names the Route53 API operation carried out by each action.
+var operations = map[string]map[string]string{
+	"rrset": {
+		"GET":  "ListResourceRecordSets",
+		"POST": "ChangeResourceRecordSets",
+	},
+	"change": {
+		"GET": "GetChange",
+	},
+	"healthcheck": {
+		"GET":  "GetHealthCheck",
+		"POST": "CreateHealthCheck",
+	},
+	"hostedzone": {
+		"LIST":   "ListHostedZones",
+		"GET":    "GetHostedZone",
+		"POST":   "CreateHostedZone",
+		"DELETE": "DeleteHostedZone",
+	},
+	"hostedzonesbyname": {
+		"LIST": "ListHostedZonesByName",
+	},
+	"hostedzonecount": {
+		"LIST": "GetHostedZoneCount",
+	},
 }
 
 type actionMethods map[string]func(*Server, http.ResponseWriter, *http.Request, string) (interface{}, error)
@@ -160,4 +1298,23 @@ var actions = map[string]actionMethods{
 		"GET":  (*Server).listResourceRecordSets,
 		"POST": (*Server).changeResourceRecordSets,
 	},
+	"change": {
+		"GET": (*Server).getChange,
+	},
+	"healthcheck": {
+		"GET":  (*Server).getHealthCheck,
+		"POST": (*Server).createHealthCheck,
+	},
+	"hostedzone": {
+		"LIST":   (*Server).listHostedZones,
+		"GET":    (*Server).getHostedZone,
+		"POST":   (*Server).createHostedZone,
+		"DELETE": (*Server).deleteHostedZone,
+	},
+	"hostedzonesbyname": {
+		"LIST": (*Server).listHostedZonesByName,
+	},
+	"hostedzonecount": {
+		"LIST": (*Server).getHostedZoneCount,
+	},
 }
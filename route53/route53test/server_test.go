@@ -0,0 +1,234 @@
+package route53test_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/pivotal-cloudops/cloudops-goamz/aws"
+	"github.com/pivotal-cloudops/cloudops-goamz/route53"
+	"github.com/pivotal-cloudops/cloudops-goamz/route53/route53test"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct {
+	srv    *route53test.Server
+	r53    *route53.Route53
+	zoneId string
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpTest(c *C) {
+	srv, err := route53test.NewServer()
+	c.Assert(err, IsNil)
+	s.srv = srv
+	s.r53 = route53.New(aws.Auth{AccessKey: "key", SecretKey: "secret"}, aws.Region{Route53Endpoint: srv.URL()})
+	s.zoneId = s.createZone(c, "example.com.")
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.srv.Quit()
+}
+
+func (s *S) createZone(c *C, name string) string {
+	resp, err := s.r53.CreateHostedZone(&route53.CreateHostedZoneRequest{Name: name, CallerReference: name})
+	c.Assert(err, IsNil)
+	return resp.HostedZone.ID
+}
+
+func record(name, typ string, values ...string) route53.ResourceRecordSet {
+	r := route53.ResourceRecordSet{Name: name, Type: typ, TTL: 300}
+	r.SetValues(values...)
+	return r
+}
+
+func (s *S) change(zoneId, action string, records ...route53.ResourceRecordSet) (route53.ChangeInfo, error) {
+	req := &route53.ChangeResourceRecordSetsRequest{}
+	for _, r := range records {
+		req.Changes = append(req.Changes, route53.Change{Action: action, Record: r})
+	}
+	resp, err := s.r53.ChangeResourceRecordSets(zoneId, req)
+	if err != nil {
+		return route53.ChangeInfo{}, err
+	}
+	return resp.ChangeInfo, nil
+}
+
+// changeWithCallerRef submits a batch creating records with the given caller
+// reference, which the client has no way of sending.
+func (s *S) changeWithCallerRef(c *C, zoneId, callerRef string, records ...route53.ResourceRecordSet) (int, route53.ChangeInfo) {
+	req := route53.ChangeResourceRecordSetsRequest{}
+	for _, r := range records {
+		req.Changes = append(req.Changes, route53.Change{Action: "CREATE", Record: r})
+	}
+	body, err := xml.Marshal(req)
+	c.Assert(err, IsNil)
+	url := fmt.Sprintf("%s/%s/hostedzone/%s/rrset", s.srv.URL(), route53.APIVersion, route53.CleanZoneID(zoneId))
+	hreq, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	hreq.Header.Set(route53test.CallerReferenceHeader, callerRef)
+	hresp, err := http.DefaultClient.Do(hreq)
+	c.Assert(err, IsNil)
+	defer hresp.Body.Close()
+	var resp route53.ChangeResourceRecordSetsResponse
+	if hresp.StatusCode == 200 {
+		c.Assert(xml.NewDecoder(hresp.Body).Decode(&resp), IsNil)
+	}
+	return hresp.StatusCode, resp.ChangeInfo
+}
+
+func assertErrorCode(c *C, err error, code string) {
+	e, ok := route53.AsError(err)
+	c.Assert(ok, Equals, true, Commentf("%v", err))
+	c.Assert(e.Code, Equals, code)
+}
+
+func (s *S) TestZonesAreIsolated(c *C) {
+	otherId := s.createZone(c, "example.org.")
+	_, err := s.change(s.zoneId, "CREATE", record("www.example.com.", "A", "10.0.0.1"))
+	c.Assert(err, IsNil)
+	_, err = s.change(otherId, "CREATE", record("www.example.org.", "A", "10.0.0.2"))
+	c.Assert(err, IsNil)
+
+	resp, err := s.r53.ListResourceRecordSets(otherId, nil)
+	c.Assert(err, IsNil)
+	var names []string
+	for _, r := range resp.Records {
+		names = append(names, r.Name+" "+r.Type)
+	}
+	c.Assert(names, DeepEquals, []string{"example.org. NS", "example.org. SOA", "www.example.org. A"})
+
+	_, err = s.change(otherId, "DELETE", record("www.example.com.", "A", "10.0.0.1"))
+	assertErrorCode(c, err, "InvalidChangeBatch")
+	_, ok := s.srv.AssertRecord("www.example.com.", "A")
+	c.Assert(ok, Equals, true)
+}
+
+func (s *S) TestZoneIdsAreNotReused(c *C) {
+	id := s.createZone(c, "example.org.")
+	_, err := s.r53.DeleteHostedZone(id)
+	c.Assert(err, IsNil)
+	newId := s.createZone(c, "example.net.")
+	c.Assert(newId, Not(Equals), id)
+	c.Assert(newId, Not(Equals), s.zoneId)
+	_, err = s.r53.GetHostedZone(id)
+	assertErrorCode(c, err, "NoSuchHostedZone")
+}
+
+func (s *S) TestCreateExistingRecordFails(c *C) {
+	_, err := s.change(s.zoneId, "CREATE", record("www.example.com.", "A", "10.0.0.1"))
+	c.Assert(err, IsNil)
+	_, err = s.change(s.zoneId, "CREATE", record("WWW.example.com", "A", "10.0.0.2"))
+	assertErrorCode(c, err, "InvalidChangeBatch")
+	_, err = s.change(s.zoneId, "CREATE", record("example.com.", "NS", "ns.example.com."))
+	assertErrorCode(c, err, "InvalidChangeBatch")
+
+	// A batch with a failing change leaves the records untouched.
+	_, err = s.change(s.zoneId, "CREATE", record("a.example.com.", "A", "10.0.0.1"), record("www.example.com.", "A", "10.0.0.1"))
+	assertErrorCode(c, err, "InvalidChangeBatch")
+	_, ok := s.srv.AssertRecord("a.example.com.", "A")
+	c.Assert(ok, Equals, false)
+	c.Assert(s.srv.ChangeBatches(), HasLen, 1)
+}
+
+func (s *S) TestCallerReferenceIsKeptPerZone(c *C) {
+	otherId := s.createZone(c, "example.org.")
+	status, info := s.changeWithCallerRef(c, s.zoneId, "ref", record("www.example.com.", "A", "10.0.0.1"))
+	c.Assert(status, Equals, 200)
+	status, again := s.changeWithCallerRef(c, s.zoneId, "ref", record("www.example.com.", "A", "10.0.0.1"))
+	c.Assert(status, Equals, 200)
+	c.Assert(again.ID, Equals, info.ID)
+	c.Assert(s.srv.ChangeBatches(), HasLen, 1)
+
+	status, _ = s.changeWithCallerRef(c, s.zoneId, "ref", record("a.example.com.", "A", "10.0.0.1"))
+	c.Assert(status, Equals, 400)
+
+	status, other := s.changeWithCallerRef(c, otherId, "ref", record("www.example.org.", "A", "10.0.0.1"))
+	c.Assert(status, Equals, 200)
+	c.Assert(other.ID, Not(Equals), info.ID)
+	c.Assert(s.srv.ChangeBatches(), HasLen, 2)
+}
+
+func (s *S) TestPendingPolls(c *C) {
+	info, err := s.change(s.zoneId, "CREATE", record("www.example.com.", "A", "10.0.0.1"))
+	c.Assert(err, IsNil)
+	c.Assert(info.Status, Equals, "PENDING")
+	status, err := s.r53.GetChange(info.ID)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, "PENDING")
+	status, err = s.r53.GetChange(info.ID)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, "INSYNC")
+
+	s.srv.SetPendingPolls(0)
+	info, err = s.change(s.zoneId, "CREATE", record("a.example.com.", "A", "10.0.0.1"))
+	c.Assert(err, IsNil)
+	status, err = s.r53.GetChange(info.ID)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, "INSYNC")
+
+	_, err = s.r53.GetChange("C999")
+	assertErrorCode(c, err, "NoSuchChange")
+}
+
+func (s *S) TestSerializeChanges(c *C) {
+	otherId := s.createZone(c, "example.org.")
+	s.srv.SetSerializeChanges(true)
+	info, err := s.change(s.zoneId, "CREATE", record("www.example.com.", "A", "10.0.0.1"))
+	c.Assert(err, IsNil)
+	_, err = s.change(s.zoneId, "CREATE", record("a.example.com.", "A", "10.0.0.1"))
+	assertErrorCode(c, err, "PriorRequestNotComplete")
+	_, err = s.change(otherId, "CREATE", record("www.example.org.", "A", "10.0.0.1"))
+	c.Assert(err, IsNil)
+
+	s.srv.AdvanceChangeStatus(info.ID)
+	_, err = s.change(s.zoneId, "CREATE", record("a.example.com.", "A", "10.0.0.1"))
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestAuthError(c *C) {
+	s.srv.SetAuthError(&route53test.Error{StatusCode: 403, Code: "InvalidClientTokenId", Message: "bad key"})
+	_, err := s.r53.ListResourceRecordSets(s.zoneId, nil)
+	assertErrorCode(c, err, "InvalidClientTokenId")
+	s.srv.SetAuthError(nil)
+	_, err = s.r53.ListResourceRecordSets(s.zoneId, nil)
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestConcurrentRequests(c *C) {
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			_, err := s.change(s.zoneId, "CREATE", record(fmt.Sprintf("host%d.example.com.", i), "A", "10.0.0.1"))
+			errs <- err
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			_, err := s.r53.ListResourceRecordSets(s.zoneId, nil)
+			errs <- err
+			s.srv.AddRecords(record(fmt.Sprintf("seed%d.example.com.", i), "A", "10.0.0.2"))
+			s.srv.ChangeBatches()
+			s.srv.Operations()
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Assert(err, IsNil)
+	}
+	c.Assert(s.srv.Records(), HasLen, 2*n)
+	c.Assert(s.srv.ChangeBatches(), HasLen, n)
+	c.Assert(s.srv.Operations(), HasLen, 2*n+1)
+}